@@ -0,0 +1,292 @@
+package conda
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+const (
+	EnvCondaCacheMaxSize = "BP_CONDA_CACHE_MAX_SIZE"
+
+	defaultCacheMaxSize = 2 << 30
+	// Bump to invalidate cached environments of earlier buildpack versions
+	envCacheFormat = "1"
+)
+
+// Fingerprint identifies the environment that the app would get: it changes
+// whenever environment.yml, a lock file, a requirement file referenced from
+// the pip section, the channel configuration, the backend or the stack does.
+func (c *Conda) Fingerprint() (string, error) {
+	backend, err := c.Backend()
+	if err != nil {
+		return "", err
+	}
+
+	// A new release of the backend in the manifest may solve or link the
+	// environment differently
+	dependency, err := c.Manifest.DefaultVersion(c.DependencyName())
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "format=%s\nbackend=%s\nversion=%s %s\nstack=%s\ndepdir=%s\n", envCacheFormat, backend, dependency.Name, dependency.Version, os.Getenv("CF_STACK"), c.Stager.DepDir())
+
+	files := append([]string{"environment.yml", "conda-lock.yml"}, explicitLockFiles...)
+	if name := os.Getenv(EnvCondaLockFile); name != "" {
+		files = append(files, name)
+	}
+	paths := make([]string, 0, len(files))
+	for _, name := range files {
+		paths = append(paths, filepath.Join(c.Stager.BuildDir(), name))
+	}
+
+	envPath := filepath.Join(c.Stager.BuildDir(), "environment.yml")
+	if exists, err := libbuildpack.FileExists(envPath); err != nil {
+		return "", err
+	} else if exists {
+		env, err := LoadEnvironment(envPath)
+		if err != nil {
+			return "", err
+		}
+		paths = append(paths, env.PipRequirementFiles()...)
+	}
+
+	if condarc := os.Getenv("CONDARC"); condarc != "" {
+		paths = append(paths, condarc)
+	}
+
+	for _, path := range paths {
+		contents, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s %d\n", path, len(contents))
+		hash.Write(contents)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))[:16], nil
+}
+
+func (c *Conda) envCacheDir() string {
+	return filepath.Join(c.Stager.CacheDir(), "conda_env")
+}
+
+func (c *Conda) pkgsCacheDir() string {
+	return filepath.Join(c.Stager.CacheDir(), "conda")
+}
+
+func (c *Conda) envDir() string {
+	return filepath.Join(c.condaHome(), "envs", "dep_env")
+}
+
+// RestoreEnvironment copies the environment cached for the fingerprint into
+// the dep dir. It returns false when there is nothing to restore.
+func (c *Conda) RestoreEnvironment(fingerprint string) (bool, error) {
+	cached := filepath.Join(c.envCacheDir(), fingerprint)
+	if exists, err := libbuildpack.FileExists(cached); err != nil || !exists {
+		return false, err
+	}
+
+	c.Log.BeginStep("Restoring conda environment from cache")
+	if err := os.RemoveAll(c.envDir()); err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(c.envDir(), 0755); err != nil {
+		return false, err
+	}
+	if err := libbuildpack.CopyDirectory(cached, c.envDir()); err != nil {
+		os.RemoveAll(c.envDir())
+		return false, fmt.Errorf("could not restore cached conda environment: %v", err)
+	}
+
+	return true, nil
+}
+
+// SaveEnvironment caches the built environment under the fingerprint. The
+// copy is renamed into place, so an interrupted save is never restored.
+func (c *Conda) SaveEnvironment(fingerprint string) error {
+	if err := os.MkdirAll(c.envCacheDir(), 0755); err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp(c.envCacheDir(), ".save-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := libbuildpack.CopyDirectory(c.envDir(), tmpDir); err != nil {
+		return fmt.Errorf("could not cache conda environment: %v", err)
+	}
+
+	cached := filepath.Join(c.envCacheDir(), fingerprint)
+	if err := os.RemoveAll(cached); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, cached)
+}
+
+// removePackageTarballs deletes downloaded package archives that conda has
+// already extracted into the package cache; they are not needed to link the
+// package into an environment again.
+func (c *Conda) removePackageTarballs() error {
+	entries, err := os.ReadDir(c.pkgsCacheDir())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		var extracted string
+		if strings.HasSuffix(name, ".tar.bz2") {
+			extracted = strings.TrimSuffix(name, ".tar.bz2")
+		} else if strings.HasSuffix(name, ".conda") {
+			extracted = strings.TrimSuffix(name, ".conda")
+		} else {
+			continue
+		}
+
+		if exists, err := libbuildpack.FileExists(filepath.Join(c.pkgsCacheDir(), extracted)); err != nil {
+			return err
+		} else if exists {
+			if err := os.Remove(filepath.Join(c.pkgsCacheDir(), name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PruneCache drops cached environments other than the current one and then
+// removes the least recently used packages until the conda caches fit into
+// BP_CONDA_CACHE_MAX_SIZE.
+func (c *Conda) PruneCache(fingerprint string) error {
+	maxSize, err := cacheMaxSize()
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(c.envCacheDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() != fingerprint {
+			c.Log.Debug("Removing cached conda environment %s", entry.Name())
+			if err := os.RemoveAll(filepath.Join(c.envCacheDir(), entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	envSize, err := dirSize(c.envCacheDir())
+	if err != nil {
+		return err
+	}
+
+	type pkg struct {
+		path    string
+		size    int64
+		modTime int64
+	}
+	var pkgs []pkg
+	var pkgsSize int64
+
+	entries, err = os.ReadDir(c.pkgsCacheDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		// urls.txt, the index cache and lock files are shared metadata
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || entry.Name() == "cache" {
+			continue
+		}
+		path := filepath.Join(c.pkgsCacheDir(), entry.Name())
+		size, err := dirSize(path)
+		if err != nil {
+			return err
+		}
+		pkgs = append(pkgs, pkg{path: path, size: size, modTime: info.ModTime().UnixNano()})
+		pkgsSize += size
+	}
+
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].modTime < pkgs[j].modTime })
+
+	for len(pkgs) > 0 && envSize+pkgsSize > maxSize {
+		c.Log.Debug("Removing cached conda package %s", filepath.Base(pkgs[0].path))
+		if err := os.RemoveAll(pkgs[0].path); err != nil {
+			return err
+		}
+		pkgsSize -= pkgs[0].size
+		pkgs = pkgs[1:]
+	}
+
+	if envSize > maxSize {
+		c.Log.Warning("The conda environment (%d MB) is larger than %s, it will not be cached", envSize>>20, EnvCondaCacheMaxSize)
+		return os.RemoveAll(filepath.Join(c.envCacheDir(), fingerprint))
+	}
+
+	return nil
+}
+
+// cacheMaxSize parses BP_CONDA_CACHE_MAX_SIZE, a number of bytes with an
+// optional K, M or G suffix.
+func cacheMaxSize() (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(os.Getenv(EnvCondaCacheMaxSize)))
+	if value == "" {
+		return defaultCacheMaxSize, nil
+	}
+
+	multiplier := int64(1)
+	for suffix, shift := range map[string]uint{"K": 10, "M": 20, "G": 30} {
+		if strings.HasSuffix(strings.TrimSuffix(value, "B"), suffix) {
+			value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), suffix)
+			multiplier = 1 << shift
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid %s %q: use a size such as 500M or 2G", EnvCondaCacheMaxSize, os.Getenv(EnvCondaCacheMaxSize))
+	}
+	return size * multiplier, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -1,7 +1,6 @@
 package conda
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"os"
@@ -21,6 +20,10 @@ type Stager interface {
 	WriteProfileD(string, string) error
 }
 
+type Manifest interface {
+	DefaultVersion(string) (libbuildpack.Dependency, error)
+}
+
 type Installer interface {
 	InstallOnlyVersion(string, string) error
 }
@@ -32,14 +35,19 @@ type Command interface {
 
 type Conda struct {
 	Installer Installer
+	Manifest  Manifest
 	Stager    Stager
 	Command   Command
 	Log       *libbuildpack.Logger
+	// BeforeEnvironment, if set, runs once conda is installed and before the
+	// environment is fingerprinted and created.
+	BeforeEnvironment func() error
 }
 
-func New(i Installer, s Stager, c Command, l *libbuildpack.Logger) *Conda {
+func New(i Installer, m Manifest, s Stager, c Command, l *libbuildpack.Logger) *Conda {
 	return &Conda{
 		Installer: i,
+		Manifest:  m,
 		Stager:    s,
 		Command:   c,
 		Log:       l,
@@ -47,19 +55,69 @@ func New(i Installer, s Stager, c Command, l *libbuildpack.Logger) *Conda {
 }
 
 func Run(c *Conda) error {
-	c.Warning()
+	if err := c.Validate(); err != nil {
+		c.Log.Error("Invalid environment.yml: %v", err)
+		return err
+	}
 
-	if err := c.Install(c.Version()); err != nil {
-		c.Log.Error("Could not install conda: %v", err)
+	if _, err := c.Backend(); err != nil {
+		c.Log.Error("Could not select the conda backend: %v", err)
+		return err
+	}
+	if _, err := c.Manifest.DefaultVersion(c.DependencyName()); err != nil {
+		c.Log.Error("This buildpack does not provide %s, the manifest needs a %s dependency: %v", c.DependencyName(), c.DependencyName(), err)
 		return err
 	}
 
-	if err := c.UpdateAndClean(); err != nil {
-		c.Log.Error("Could not update conda env: %v", err)
+	if err := c.Install(c.DependencyName()); err != nil {
+		c.Log.Error("Could not install conda: %v", err)
 		return err
 	}
 
+	if c.BeforeEnvironment != nil {
+		if err := c.BeforeEnvironment(); err != nil {
+			return err
+		}
+	}
+
+	fingerprint, err := c.Fingerprint()
+	if err != nil {
+		c.Log.Warning("Could not fingerprint the conda environment, not caching it: %v", err)
+	}
+
+	restored := false
+	if fingerprint != "" {
+		if restored, err = c.RestoreEnvironment(fingerprint); err != nil {
+			c.Log.Warning("%v", err)
+		}
+	}
+
+	if !restored {
+		if err := c.UpdateAndClean(); err != nil {
+			c.Log.Error("Could not update conda env: %v", err)
+			return err
+		}
+
+		if fingerprint != "" {
+			if err := c.SaveEnvironment(fingerprint); err != nil {
+				c.Log.Warning("Could not cache conda env: %v", err)
+			}
+		}
+	}
+
+	if fingerprint != "" {
+		if err := c.PruneCache(fingerprint); err != nil {
+			c.Log.Warning("Could not prune conda cache: %v", err)
+		}
+	}
+
 	c.Stager.LinkDirectoryInDepDir(c.condaBin(), "bin")
+	// The environment's interpreter and scripts shadow those of the base
+	// installation, so later staging steps run with the app's packages
+	if err := c.Stager.LinkDirectoryInDepDir(filepath.Dir(c.Python()), "bin"); err != nil {
+		c.Log.Error("Could not link conda environment: %v", err)
+		return err
+	}
 	if err := c.Stager.WriteProfileD("conda.sh", c.ProfileD()); err != nil {
 		c.Log.Error("Could not write profile.d script: %v", err)
 		return err
@@ -69,11 +127,19 @@ func Run(c *Conda) error {
 	return nil
 }
 
-func (c *Conda) Version() string {
+// DependencyName returns the manifest dependency that provides the backend.
+func (c *Conda) DependencyName() string {
+	if c.isMicromamba() {
+		return "micromamba"
+	}
 	return "miniforge"
 }
 
 func (c *Conda) Install(version string) error {
+	if c.isMicromamba() {
+		return c.installMicromamba(version)
+	}
+
 	c.Log.BeginStep("Supplying conda")
 	var installer string
 	if installerDir, err := os.MkdirTemp("", "miniforge"); err != nil {
@@ -100,27 +166,52 @@ func (c *Conda) Install(version string) error {
 
 func (c *Conda) UpdateAndClean() error {
 	c.Log.BeginStep("Installing Dependencies")
-	c.Log.BeginStep("Installing conda environment from environment.yml")
 
 	verbosity := []string{"--quiet"}
 	if os.Getenv("BP_DEBUG") != "" {
 		verbosity = []string{"--debug", "--verbose"}
+		if c.isMicromamba() {
+			verbosity = []string{"--log-level", "debug"}
+		}
 	}
 
-	condaCache := filepath.Join(c.Stager.CacheDir(), "conda")
+	if c.isMicromamba() {
+		c.Log.Debug("Setting MAMBA_ROOT_PREFIX to %s", c.condaHome())
+		if err := os.Setenv("MAMBA_ROOT_PREFIX", c.condaHome()); err != nil {
+			return fmt.Errorf("setting MAMBA_ROOT_PREFIX: %w", err)
+		}
+	}
+
+	condaCache := c.pkgsCacheDir()
 	c.Log.Debug("Setting CONDA_PKGS_DIRS to %s", condaCache)
 	if err := os.Setenv("CONDA_PKGS_DIRS", condaCache); err != nil {
 		return fmt.Errorf("setting CONDA_PKGS_DIRS: %w", err)
 	}
 
-	args := append(append([]string{"env", "update"}, verbosity...), "-n", "dep_env", "-f", filepath.Join(c.Stager.BuildDir(), "environment.yml"))
-	c.Log.Debug("Run Conda: %s %s", c.condaExec(), strings.Join(args, " "))
-	if err := c.Command.Execute("/", indentWriter(os.Stdout), indentWriter(os.Stderr), c.condaExec(), args...); err != nil {
-		return fmt.Errorf("Could not run conda env update: %v", err)
+	lock, err := c.FindLockFile()
+	if err != nil {
+		return err
+	}
+
+	if lock != nil {
+		if err := c.InstallLockFile(lock, verbosity); err != nil {
+			return err
+		}
+	} else {
+		c.Log.BeginStep("Installing conda environment from environment.yml")
+		args := append(append([]string{"env", "update"}, verbosity...), "-n", "dep_env", "-f", filepath.Join(c.Stager.BuildDir(), "environment.yml"))
+		if c.isMicromamba() {
+			args = append(append([]string{"create", "--yes"}, verbosity...), "-n", "dep_env", "-f", filepath.Join(c.Stager.BuildDir(), "environment.yml"))
+		}
+		c.Log.Debug("Run Conda: %s %s", c.condaExec(), strings.Join(args, " "))
+		if err := c.Command.Execute("/", indentWriter(os.Stdout), indentWriter(os.Stderr), c.condaExec(), args...); err != nil {
+			return fmt.Errorf("Could not run %s %s: %v", filepath.Base(c.condaExec()), strings.Join(args[:2], " "), err)
+		}
 	}
-	if err := c.Command.Execute("/", indentWriter(os.Stdout), indentWriter(os.Stderr), c.condaExec(), "clean", "-pt"); err != nil {
-		c.Log.Error("Could not run conda clean: %v", err)
-		return fmt.Errorf("Could not run conda clean: %v", err)
+
+	if err := c.removePackageTarballs(); err != nil {
+		c.Log.Error("Could not clean conda package cache: %v", err)
+		return fmt.Errorf("Could not clean conda package cache: %v", err)
 	}
 
 	return nil
@@ -135,31 +226,26 @@ func (c *Conda) condaBin() string {
 }
 
 func (c *Conda) condaExec() string {
+	if c.isMicromamba() {
+		return filepath.Join(c.condaBin(), "micromamba")
+	}
 	return filepath.Join(c.condaBin(), "conda")
 }
 
+// Python returns the interpreter of the environment created from environment.yml.
+func (c *Conda) Python() string {
+	return filepath.Join(c.envDir(), "bin", "python")
+}
+
 func (c *Conda) ProfileD() string {
+	if c.isMicromamba() {
+		return c.micromambaProfileD()
+	}
 	return fmt.Sprintf(`grep -rlI %s $DEPS_DIR/%s/conda | xargs sed -i -e "s|%s|$DEPS_DIR/%s|g"
 source activate dep_env
 `, c.Stager.DepDir(), c.Stager.DepsIdx(), c.Stager.DepDir(), c.Stager.DepsIdx())
 }
 
-func (c *Conda) Warning() error {
-	if exists, err := libbuildpack.FileExists(filepath.Join(c.Stager.BuildDir(), "runtime.txt")); err != nil {
-		return err
-	} else if !exists {
-		return nil
-	}
-	if contents, err := os.ReadFile(filepath.Join(c.Stager.BuildDir(), "environment.yml")); err != nil {
-		return err
-	} else {
-		if bytes.Contains(contents, []byte("python=")) {
-			c.Log.Warning("you have specified the version of Python runtime both in 'runtime.txt' and 'environment.yml'. You should remove one of the two versions")
-		}
-	}
-	return nil
-}
-
 func indentWriter(writer io.Writer) io.Writer {
 	return text.NewIndentWriter(writer, []byte("       "))
 }
@@ -2,9 +2,12 @@ package conda_test
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/cloudfoundry/python-buildpack/src/python/conda"
 
@@ -25,11 +28,13 @@ var _ = Describe("Conda", func() {
 		depsDir       string
 		depsIdx       string
 		depDir        string
+		condaVersion  string
 		subject       *conda.Conda
 		logger        *libbuildpack.Logger
 		buffer        *bytes.Buffer
 		mockCtrl      *gomock.Controller
 		mockInstaller *MockInstaller
+		mockManifest  *MockManifest
 		mockStager    *MockStager
 		mockCommand   *MockCommand
 	)
@@ -49,6 +54,14 @@ var _ = Describe("Conda", func() {
 
 		mockCtrl = gomock.NewController(GinkgoT())
 		mockInstaller = NewMockInstaller(mockCtrl)
+		condaVersion = "24.7.1"
+		mockManifest = NewMockManifest(mockCtrl)
+		mockManifest.EXPECT().DefaultVersion(gomock.Any()).AnyTimes().DoAndReturn(func(name string) (libbuildpack.Dependency, error) {
+			if condaVersion == "" {
+				return libbuildpack.Dependency{}, fmt.Errorf("no match found for %s", name)
+			}
+			return libbuildpack.Dependency{Name: name, Version: condaVersion}, nil
+		})
 		mockStager = NewMockStager(mockCtrl)
 		mockStager.EXPECT().BuildDir().AnyTimes().Return(buildDir)
 		mockStager.EXPECT().CacheDir().AnyTimes().Return(cacheDir)
@@ -59,23 +72,23 @@ var _ = Describe("Conda", func() {
 		buffer = new(bytes.Buffer)
 		logger = libbuildpack.NewLogger(ansicleaner.New(buffer))
 
-		subject = conda.New(mockInstaller, mockStager, mockCommand, logger)
+		subject = conda.New(mockInstaller, mockManifest, mockStager, mockCommand, logger)
 	})
 
-	Describe("Version", func() {
+	Describe("DependencyName", func() {
 		Context("runtime.txt specifies python 3", func() {
 			BeforeEach(func() {
 				Expect(os.WriteFile(filepath.Join(buildDir, "runtime.txt"), []byte("python-3.2.3"), 0644)).To(Succeed())
 			})
 
 			It("returns 'miniforge'", func() {
-				Expect(subject.Version()).To(Equal("miniforge"))
+				Expect(subject.DependencyName()).To(Equal("miniforge"))
 			})
 		})
 
 		Context("runtime.txt does not exist", func() {
 			It("returns 'miniforge'", func() {
-				Expect(subject.Version()).To(Equal("miniforge"))
+				Expect(subject.DependencyName()).To(Equal("miniforge"))
 			})
 		})
 	})
@@ -135,7 +148,6 @@ var _ = Describe("Conda", func() {
 
 		It("uses staging cache for conda cache", func() {
 			mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), filepath.Join(depDir, "conda", "bin", "conda"), "env", "update", "--quiet", "-n", "dep_env", "-f", filepath.Join(buildDir, "environment.yml"))
-			mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), filepath.Join(depDir, "conda", "bin", "conda"), "clean", "-pt")
 
 			Expect(subject.UpdateAndClean()).To(Succeed())
 			Expect(os.Getenv("CONDA_PKGS_DIRS")).To(Equal(filepath.Join(cacheDir, "conda")))
@@ -144,7 +156,6 @@ var _ = Describe("Conda", func() {
 		Context("BP_DEBUG == false", func() {
 			It("calls update and clean on conda (with quiet flag)", func() {
 				mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), filepath.Join(depDir, "conda", "bin", "conda"), "env", "update", "--quiet", "-n", "dep_env", "-f", filepath.Join(buildDir, "environment.yml"))
-				mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), filepath.Join(depDir, "conda", "bin", "conda"), "clean", "-pt")
 				Expect(subject.UpdateAndClean()).To(Succeed())
 			})
 		})
@@ -156,10 +167,435 @@ var _ = Describe("Conda", func() {
 
 			It("calls update and clean on conda (with debug and verbose flags)", func() {
 				mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), filepath.Join(depDir, "conda", "bin", "conda"), "env", "update", "--debug", "--verbose", "-n", "dep_env", "-f", filepath.Join(buildDir, "environment.yml"))
-				mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), filepath.Join(depDir, "conda", "bin", "conda"), "clean", "-pt")
 				Expect(subject.UpdateAndClean()).To(Succeed())
 			})
 		})
+
+		Context("the app has an explicit spec file", func() {
+			BeforeEach(func() {
+				Expect(os.WriteFile(filepath.Join(buildDir, "conda-linux-64.lock"), []byte("# platform: linux-64\n@EXPLICIT\nhttps://conda.anaconda.org/conda-forge/linux-64/python-3.12.1-h0.conda#0123456789abcdef\n"), 0644)).To(Succeed())
+			})
+
+			It("creates the environment without solving", func() {
+				mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), filepath.Join(depDir, "conda", "bin", "conda"), "create", "--yes", "--quiet", "-n", "dep_env", "--file", gomock.Any()).DoAndReturn(func(_ string, _, _ io.Writer, _ string, args ...string) error {
+					contents, err := os.ReadFile(args[len(args)-1])
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(contents)).To(Equal("@EXPLICIT\nhttps://conda.anaconda.org/conda-forge/linux-64/python-3.12.1-h0.conda#0123456789abcdef\n"))
+					return nil
+				})
+
+				Expect(subject.UpdateAndClean()).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("Installing conda environment from conda-linux-64.lock"))
+			})
+
+			It("fails when a package has no hash", func() {
+				Expect(os.WriteFile(filepath.Join(buildDir, "conda-linux-64.lock"), []byte("@EXPLICIT\nhttps://conda.anaconda.org/conda-forge/linux-64/python-3.12.1-h0.conda\n"), 0644)).To(Succeed())
+
+				Expect(subject.UpdateAndClean()).To(MatchError(ContainSubstring("conda-linux-64.lock has no hash for")))
+			})
+		})
+
+		Context("the app has a conda-lock.yml", func() {
+			BeforeEach(func() {
+				Expect(os.WriteFile(filepath.Join(buildDir, "conda-lock.yml"), []byte(`version: 1
+package:
+- name: python
+  version: 3.12.1
+  manager: conda
+  platform: linux-64
+  url: https://conda.anaconda.org/conda-forge/linux-64/python-3.12.1-h0.conda
+  hash:
+    md5: 0123456789abcdef
+    sha256: fedcba9876543210
+- name: python
+  version: 3.12.1
+  manager: conda
+  platform: osx-arm64
+  url: https://conda.anaconda.org/conda-forge/osx-arm64/python-3.12.1-h0.conda
+  hash:
+    md5: abcdef
+- name: requests
+  version: 2.31.0
+  manager: pip
+  platform: linux-64
+  url: https://files.pythonhosted.org/packages/requests-2.31.0-py3-none-any.whl
+  hash:
+    sha256: 58cd2187c01e70e6e26505bca751777aa9f2ee0b7f4300988b709f44e013003f
+`), 0644)).To(Succeed())
+			})
+
+			It("installs the linux-64 conda packages and the pip packages with hashes", func() {
+				mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), filepath.Join(depDir, "conda", "bin", "conda"), "create", "--yes", "--quiet", "-n", "dep_env", "--file", gomock.Any()).DoAndReturn(func(_ string, _, _ io.Writer, _ string, args ...string) error {
+					contents, err := os.ReadFile(args[len(args)-1])
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(contents)).To(Equal("@EXPLICIT\nhttps://conda.anaconda.org/conda-forge/linux-64/python-3.12.1-h0.conda#0123456789abcdef\n"))
+					return nil
+				})
+				mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), filepath.Join(depDir, "conda", "envs", "dep_env", "bin", "python"), "-m", "pip", "install", "--no-deps", "--require-hashes", "-r", gomock.Any()).DoAndReturn(func(_ string, _, _ io.Writer, _ string, args ...string) error {
+					contents, err := os.ReadFile(args[len(args)-1])
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(contents)).To(Equal("requests @ https://files.pythonhosted.org/packages/requests-2.31.0-py3-none-any.whl --hash=sha256:58cd2187c01e70e6e26505bca751777aa9f2ee0b7f4300988b709f44e013003f\n"))
+					return nil
+				})
+
+				Expect(subject.UpdateAndClean()).To(Succeed())
+			})
+		})
+	})
+
+	Context("BP_CONDA_BACKEND == micromamba", func() {
+		BeforeEach(func() {
+			DeferCleanup(os.Setenv, "BP_CONDA_BACKEND", os.Getenv("BP_CONDA_BACKEND"))
+			DeferCleanup(os.Setenv, "MAMBA_ROOT_PREFIX", os.Getenv("MAMBA_ROOT_PREFIX"))
+			DeferCleanup(os.Setenv, "CONDA_PKGS_DIRS", os.Getenv("CONDA_PKGS_DIRS"))
+			os.Setenv("BP_CONDA_BACKEND", "micromamba")
+		})
+
+		It("returns 'micromamba'", func() {
+			Expect(subject.DependencyName()).To(Equal("micromamba"))
+		})
+
+		It("fails when the manifest has no micromamba dependency", func() {
+			condaVersion = ""
+			Expect(os.WriteFile(filepath.Join(buildDir, "environment.yml"), []byte("dependencies:\n  - python=3.11\n"), 0644)).To(Succeed())
+
+			Expect(conda.Run(subject)).To(MatchError("no match found for micromamba"))
+			Expect(buffer.String()).To(ContainSubstring("This buildpack does not provide micromamba, the manifest needs a micromamba dependency"))
+		})
+
+		It("installs the micromamba binary of the release tarball into the root prefix", func() {
+			micromamba := filepath.Join(depDir, "conda", "bin", "micromamba")
+			mockInstaller.EXPECT().InstallOnlyVersion("micromamba", gomock.Any()).Do(func(_, dir string) {
+				Expect(dir).NotTo(HavePrefix(depDir))
+				Expect(os.MkdirAll(filepath.Join(dir, "bin"), 0755)).To(Succeed())
+				Expect(os.MkdirAll(filepath.Join(dir, "info"), 0755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(dir, "bin", "micromamba"), []byte("micromamba"), 0644)).To(Succeed())
+			})
+			mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), micromamba, "--version")
+
+			Expect(subject.Install("micromamba")).To(Succeed())
+
+			fi, err := os.Stat(micromamba)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fi.Mode()).To(Equal(os.FileMode(0755)))
+			Expect(os.ReadFile(micromamba)).To(Equal([]byte("micromamba")))
+		})
+
+		It("installs a bare micromamba binary", func() {
+			micromamba := filepath.Join(depDir, "conda", "bin", "micromamba")
+			mockInstaller.EXPECT().InstallOnlyVersion("micromamba", gomock.Any()).Do(func(_, dir string) {
+				Expect(os.WriteFile(filepath.Join(dir, "micromamba-linux-64"), []byte("micromamba"), 0644)).To(Succeed())
+			})
+			mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), micromamba, "--version")
+
+			Expect(subject.Install("micromamba")).To(Succeed())
+			Expect(os.ReadFile(micromamba)).To(Equal([]byte("micromamba")))
+		})
+
+		It("fails when the dependency has no micromamba binary", func() {
+			mockInstaller.EXPECT().InstallOnlyVersion("micromamba", gomock.Any()).Do(func(_, dir string) {
+				Expect(os.MkdirAll(filepath.Join(dir, "bin"), 0755)).To(Succeed())
+				Expect(os.MkdirAll(filepath.Join(dir, "info"), 0755)).To(Succeed())
+			})
+
+			Expect(subject.Install("micromamba")).To(MatchError("the micromamba dependency has no bin/micromamba"))
+		})
+
+		It("creates the environment from environment.yml", func() {
+			micromamba := filepath.Join(depDir, "conda", "bin", "micromamba")
+			mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), micromamba, "create", "--yes", "--quiet", "-n", "dep_env", "-f", filepath.Join(buildDir, "environment.yml"))
+
+			Expect(subject.UpdateAndClean()).To(Succeed())
+			Expect(os.Getenv("MAMBA_ROOT_PREFIX")).To(Equal(filepath.Join(depDir, "conda")))
+			Expect(os.Getenv("CONDA_PKGS_DIRS")).To(Equal(filepath.Join(cacheDir, "conda")))
+		})
+
+		It("activates dep_env without the conda shell functions", func() {
+			profileD := subject.ProfileD()
+			Expect(profileD).To(HavePrefix(`grep -rlI ` + depDir + ` $DEPS_DIR/13/conda | xargs sed -i -e "s|` + depDir + `|$DEPS_DIR/13|g"`))
+			Expect(profileD).To(ContainSubstring(`export CONDA_PREFIX="$MAMBA_ROOT_PREFIX/envs/dep_env"`))
+			Expect(profileD).To(ContainSubstring(`export PATH="$CONDA_PREFIX/bin:$PATH"`))
+			Expect(profileD).NotTo(ContainSubstring("source activate"))
+		})
+	})
+
+	It("rejects an unknown BP_CONDA_BACKEND", func() {
+		DeferCleanup(os.Setenv, "BP_CONDA_BACKEND", os.Getenv("BP_CONDA_BACKEND"))
+		os.Setenv("BP_CONDA_BACKEND", "mamba")
+
+		Expect(conda.Run(subject)).To(MatchError(ContainSubstring("BP_CONDA_BACKEND must be conda or micromamba")))
+	})
+
+	Describe("environment cache", func() {
+		var fingerprint string
+
+		BeforeEach(func() {
+			DeferCleanup(os.Setenv, "BP_CONDA_CACHE_MAX_SIZE", os.Getenv("BP_CONDA_CACHE_MAX_SIZE"))
+			DeferCleanup(os.Setenv, "CF_STACK", os.Getenv("CF_STACK"))
+			os.Setenv("CF_STACK", "cflinuxfs4")
+			Expect(os.WriteFile(filepath.Join(buildDir, "environment.yml"), []byte("dependencies:\n  - python=3.11\n"), 0644)).To(Succeed())
+			fingerprint, err = subject.Fingerprint()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		Describe("Fingerprint", func() {
+			It("changes with environment.yml", func() {
+				Expect(os.WriteFile(filepath.Join(buildDir, "environment.yml"), []byte("dependencies:\n  - python=3.12\n"), 0644)).To(Succeed())
+				Expect(subject.Fingerprint()).NotTo(Equal(fingerprint))
+			})
+
+			It("changes with the stack", func() {
+				os.Setenv("CF_STACK", "cflinuxfs5")
+				Expect(subject.Fingerprint()).NotTo(Equal(fingerprint))
+			})
+
+			It("changes with the version of the backend in the manifest", func() {
+				condaVersion = "25.1.0"
+				Expect(subject.Fingerprint()).NotTo(Equal(fingerprint))
+			})
+
+			It("changes with a lock file", func() {
+				Expect(os.WriteFile(filepath.Join(buildDir, "conda-linux-64.lock"), []byte("@EXPLICIT\n"), 0644)).To(Succeed())
+				Expect(subject.Fingerprint()).NotTo(Equal(fingerprint))
+			})
+
+			It("is stable", func() {
+				Expect(subject.Fingerprint()).To(Equal(fingerprint))
+			})
+		})
+
+		Describe("SaveEnvironment and RestoreEnvironment", func() {
+			BeforeEach(func() {
+				Expect(os.MkdirAll(filepath.Join(depDir, "conda", "envs", "dep_env", "bin"), 0755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(depDir, "conda", "envs", "dep_env", "bin", "python3.11"), []byte("python"), 0755)).To(Succeed())
+				Expect(os.Symlink("python3.11", filepath.Join(depDir, "conda", "envs", "dep_env", "bin", "python"))).To(Succeed())
+			})
+
+			It("restores a saved environment", func() {
+				Expect(subject.SaveEnvironment(fingerprint)).To(Succeed())
+				Expect(os.RemoveAll(filepath.Join(depDir, "conda"))).To(Succeed())
+
+				Expect(subject.RestoreEnvironment(fingerprint)).To(BeTrue())
+				Expect(os.ReadFile(filepath.Join(depDir, "conda", "envs", "dep_env", "bin", "python3.11"))).To(Equal([]byte("python")))
+				Expect(os.Readlink(filepath.Join(depDir, "conda", "envs", "dep_env", "bin", "python"))).To(Equal("python3.11"))
+			})
+
+			It("does not restore an environment of another fingerprint", func() {
+				Expect(subject.SaveEnvironment("other")).To(Succeed())
+				Expect(subject.RestoreEnvironment(fingerprint)).To(BeFalse())
+			})
+		})
+
+		Describe("Run", func() {
+			It("reuses the cached environment instead of updating it", func() {
+				Expect(os.MkdirAll(filepath.Join(cacheDir, "conda_env", fingerprint, "bin"), 0755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(cacheDir, "conda_env", fingerprint, "bin", "python"), []byte("python"), 0755)).To(Succeed())
+
+				mockInstaller.EXPECT().InstallOnlyVersion("miniforge", gomock.Any()).Do(func(_, path string) {
+					Expect(os.WriteFile(path, []byte{}, 0644)).To(Succeed())
+				})
+				mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), gomock.Any(), "-b", "-p", filepath.Join(depDir, "conda"))
+				mockStager.EXPECT().LinkDirectoryInDepDir(filepath.Join(depDir, "conda", "bin"), "bin")
+				mockStager.EXPECT().LinkDirectoryInDepDir(filepath.Join(depDir, "conda", "envs", "dep_env", "bin"), "bin")
+				mockStager.EXPECT().WriteProfileD("conda.sh", gomock.Any())
+
+				Expect(conda.Run(subject)).To(Succeed())
+				Expect(filepath.Join(depDir, "conda", "envs", "dep_env", "bin", "python")).To(BeARegularFile())
+				Expect(buffer.String()).To(ContainSubstring("Restoring conda environment from cache"))
+			})
+
+			It("runs BeforeEnvironment once conda is installed", func() {
+				installed := false
+				mockInstaller.EXPECT().InstallOnlyVersion("miniforge", gomock.Any()).Do(func(_, path string) {
+					Expect(os.WriteFile(path, []byte{}, 0644)).To(Succeed())
+				})
+				mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), gomock.Any(), "-b", "-p", filepath.Join(depDir, "conda")).Do(func(string, io.Writer, io.Writer, string, ...string) {
+					installed = true
+				})
+				subject.BeforeEnvironment = func() error {
+					Expect(installed).To(BeTrue())
+					return errors.New("hook failed")
+				}
+
+				Expect(conda.Run(subject)).To(MatchError("hook failed"))
+			})
+
+			It("only warns when the cache cannot be pruned", func() {
+				os.Setenv("BP_CONDA_CACHE_MAX_SIZE", "lots")
+				Expect(os.MkdirAll(filepath.Join(cacheDir, "conda_env", fingerprint, "bin"), 0755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(cacheDir, "conda_env", fingerprint, "bin", "python"), []byte("python"), 0755)).To(Succeed())
+
+				mockInstaller.EXPECT().InstallOnlyVersion("miniforge", gomock.Any()).Do(func(_, path string) {
+					Expect(os.WriteFile(path, []byte{}, 0644)).To(Succeed())
+				})
+				mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), gomock.Any(), "-b", "-p", filepath.Join(depDir, "conda"))
+				mockStager.EXPECT().LinkDirectoryInDepDir(gomock.Any(), "bin").Times(2)
+				mockStager.EXPECT().WriteProfileD("conda.sh", gomock.Any())
+
+				Expect(conda.Run(subject)).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Could not prune conda cache: invalid BP_CONDA_CACHE_MAX_SIZE "lots"`))
+			})
+		})
+
+		Describe("PruneCache", func() {
+			writePackage := func(name string, size int, modTime time.Time) {
+				Expect(os.MkdirAll(filepath.Join(cacheDir, "conda", name), 0755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(cacheDir, "conda", name, "data"), make([]byte, size), 0644)).To(Succeed())
+				Expect(os.Chtimes(filepath.Join(cacheDir, "conda", name), modTime, modTime)).To(Succeed())
+			}
+
+			BeforeEach(func() {
+				Expect(os.MkdirAll(filepath.Join(cacheDir, "conda_env", fingerprint), 0755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(cacheDir, "conda_env", fingerprint, "python"), make([]byte, 1024), 0644)).To(Succeed())
+				Expect(os.MkdirAll(filepath.Join(cacheDir, "conda_env", "stale"), 0755)).To(Succeed())
+
+				writePackage("old-1.0-0", 2048, time.Now().Add(-2*time.Hour))
+				writePackage("new-1.0-0", 2048, time.Now())
+			})
+
+			It("removes other cached environments", func() {
+				Expect(subject.PruneCache(fingerprint)).To(Succeed())
+				Expect(filepath.Join(cacheDir, "conda_env", "stale")).NotTo(BeADirectory())
+				Expect(filepath.Join(cacheDir, "conda_env", fingerprint)).To(BeADirectory())
+			})
+
+			It("removes the least recently used packages above the size cap", func() {
+				os.Setenv("BP_CONDA_CACHE_MAX_SIZE", "4K")
+
+				Expect(subject.PruneCache(fingerprint)).To(Succeed())
+				Expect(filepath.Join(cacheDir, "conda", "old-1.0-0")).NotTo(BeADirectory())
+				Expect(filepath.Join(cacheDir, "conda", "new-1.0-0")).To(BeADirectory())
+			})
+
+			It("does not cache an environment larger than the cap", func() {
+				os.Setenv("BP_CONDA_CACHE_MAX_SIZE", "512")
+
+				Expect(subject.PruneCache(fingerprint)).To(Succeed())
+				Expect(filepath.Join(cacheDir, "conda_env", fingerprint)).NotTo(BeADirectory())
+				Expect(buffer.String()).To(ContainSubstring("it will not be cached"))
+			})
+
+			It("rejects an invalid size", func() {
+				os.Setenv("BP_CONDA_CACHE_MAX_SIZE", "lots")
+				Expect(subject.PruneCache(fingerprint)).To(MatchError(ContainSubstring(`invalid BP_CONDA_CACHE_MAX_SIZE "lots"`)))
+			})
+		})
+
+		It("removes extracted package tarballs after installing", func() {
+			Expect(os.MkdirAll(filepath.Join(cacheDir, "conda", "python-3.11.4-0"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(cacheDir, "conda", "python-3.11.4-0.conda"), []byte{}, 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(cacheDir, "conda", "pending-1.0-0.tar.bz2"), []byte{}, 0644)).To(Succeed())
+			mockCommand.EXPECT().Execute("/", gomock.Any(), gomock.Any(), filepath.Join(depDir, "conda", "bin", "conda"), "env", "update", "--quiet", "-n", "dep_env", "-f", filepath.Join(buildDir, "environment.yml"))
+
+			Expect(subject.UpdateAndClean()).To(Succeed())
+			Expect(filepath.Join(cacheDir, "conda", "python-3.11.4-0.conda")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(cacheDir, "conda", "pending-1.0-0.tar.bz2")).To(BeAnExistingFile())
+		})
+	})
+
+	Describe("Validate", func() {
+		BeforeEach(func() {
+			Expect(os.WriteFile(filepath.Join(buildDir, "environment.yml"), []byte(`name: app
+channels:
+  - conda-forge
+dependencies:
+  - python=3.11
+  - pip
+  - pip:
+    - -r requirements.txt
+`), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(buildDir, "requirements.txt"), []byte("flask\n"), 0644)).To(Succeed())
+		})
+
+		It("accepts a valid environment.yml", func() {
+			Expect(subject.Validate()).To(Succeed())
+			Expect(buffer.String()).To(BeEmpty())
+		})
+
+		It("fails when a pip requirement file does not exist", func() {
+			Expect(os.Remove(filepath.Join(buildDir, "requirements.txt"))).To(Succeed())
+			Expect(subject.Validate()).To(MatchError(ContainSubstring("the pip section references " + filepath.Join(buildDir, "requirements.txt") + ", which does not exist")))
+		})
+
+		It("fails on an invalid channel", func() {
+			Expect(os.WriteFile(filepath.Join(buildDir, "environment.yml"), []byte("channels:\n  - gopher://example.com/conda\ndependencies:\n  - python\n"), 0644)).To(Succeed())
+			Expect(subject.Validate()).To(MatchError(ContainSubstring(`channel "gopher://example.com/conda" is not a supported URL`)))
+		})
+
+		It("fails on an unsupported dependency section", func() {
+			Expect(os.WriteFile(filepath.Join(buildDir, "environment.yml"), []byte("dependencies:\n  - npm:\n    - left-pad\n"), 0644)).To(Succeed())
+			Expect(subject.Validate()).To(MatchError(ContainSubstring("only pip is supported")))
+		})
+
+		Context("runtime.txt agrees with the python pin", func() {
+			BeforeEach(func() {
+				Expect(os.WriteFile(filepath.Join(buildDir, "runtime.txt"), []byte("python-3.11.4"), 0644)).To(Succeed())
+			})
+
+			It("warns that the version is specified twice", func() {
+				Expect(subject.Validate()).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("both in 'runtime.txt' and 'environment.yml'"))
+			})
+		})
+
+		Context("runtime.txt conflicts with the python pin", func() {
+			BeforeEach(func() {
+				Expect(os.WriteFile(filepath.Join(buildDir, "runtime.txt"), []byte("python-3.12.x"), 0644)).To(Succeed())
+			})
+
+			It("fails", func() {
+				Expect(subject.Validate()).To(MatchError("runtime.txt requests python 3.12.x, but environment.yml pins python=3.11. Remove runtime.txt or make the two versions agree"))
+			})
+		})
+	})
+
+	DescribeTable("SatisfiesPython",
+		func(version, spec string, expected bool) {
+			Expect(conda.SatisfiesPython(version, spec)).To(Equal(expected))
+		},
+		Entry("fuzzy pin", "3.11.4", "=3.11", true),
+		Entry("fuzzy pin of another minor", "3.12.1", "=3.11", false),
+		Entry("exact pin", "3.11.4", "==3.11.4", true),
+		Entry("exact pin of another patch", "3.11.5", "==3.11.4", false),
+		Entry("wildcard", "3.11.x", "3.11.*", true),
+		Entry("range", "3.11.4", ">=3.10,<3.12", true),
+		Entry("outside range", "3.12.x", ">=3.10,<3.12", false),
+		Entry("alternatives", "3.10.2", "3.9|3.10", true),
+		Entry("no spec", "3.10.2", "", true),
+	)
+
+	Describe("HasEnvironment", func() {
+		It("is false without environment.yml or lock file", func() {
+			Expect(conda.HasEnvironment(buildDir)).To(BeFalse())
+		})
+
+		It("is true with a conda-lock.yml", func() {
+			Expect(os.WriteFile(filepath.Join(buildDir, "conda-lock.yml"), []byte(""), 0644)).To(Succeed())
+			Expect(conda.HasEnvironment(buildDir)).To(BeTrue())
+		})
+
+		It("is false with a generic spec file of a pip app", func() {
+			Expect(os.WriteFile(filepath.Join(buildDir, "explicit.txt"), []byte("flask\n"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(buildDir, "spec-file.txt"), []byte("flask\n"), 0644)).To(Succeed())
+			Expect(conda.HasEnvironment(buildDir)).To(BeFalse())
+		})
+
+		Context("BP_CONDA_LOCK_FILE is set", func() {
+			BeforeEach(func() {
+				DeferCleanup(os.Setenv, "BP_CONDA_LOCK_FILE", os.Getenv("BP_CONDA_LOCK_FILE"))
+				Expect(os.Setenv("BP_CONDA_LOCK_FILE", "locks/prod.txt")).To(Succeed())
+			})
+
+			It("is false when the named file does not exist", func() {
+				Expect(conda.HasEnvironment(buildDir)).To(BeFalse())
+			})
+
+			It("is true when the named file exists", func() {
+				Expect(os.Mkdir(filepath.Join(buildDir, "locks"), 0755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(buildDir, "locks", "prod.txt"), []byte("@EXPLICIT\n"), 0644)).To(Succeed())
+				Expect(conda.HasEnvironment(buildDir)).To(BeTrue())
+			})
+		})
 	})
 
 	It("ProfileD", func() {
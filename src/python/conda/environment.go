@@ -0,0 +1,310 @@
+package conda
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// Environment is the parsed environment.yml of an app.
+type Environment struct {
+	Path     string
+	Name     string
+	Channels []string
+	// Dependencies are the conda match specs, e.g. "python=3.11"
+	Dependencies []string
+	// Pip are the entries of the nested pip section, including options
+	// such as "-r requirements.txt"
+	Pip []string
+}
+
+type environmentYml struct {
+	Name         string        `yaml:"name"`
+	Channels     []interface{} `yaml:"channels"`
+	Dependencies []interface{} `yaml:"dependencies"`
+}
+
+var (
+	matchSpecNameRegex = regexp.MustCompile(`^([A-Za-z0-9_.\-]+(?:::[A-Za-z0-9_.\-]+)?)\s*(.*)$`)
+	channelNameRegex   = regexp.MustCompile(`^[A-Za-z0-9_.\-/]+$`)
+	channelSchemes     = []string{"http://", "https://", "file://", "s3://", "ftp://"}
+)
+
+// LoadEnvironment parses and validates an environment.yml.
+func LoadEnvironment(path string) (*Environment, error) {
+	var envYml environmentYml
+	if err := libbuildpack.NewYAML().Load(path, &envYml); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", filepath.Base(path), err)
+	}
+
+	env := &Environment{Path: path, Name: envYml.Name}
+
+	for _, channel := range envYml.Channels {
+		name, ok := channel.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: channel %v is not a string", filepath.Base(path), channel)
+		}
+		if err := validateChannel(name); err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
+		}
+		env.Channels = append(env.Channels, name)
+	}
+
+	for _, dependency := range envYml.Dependencies {
+		switch dep := dependency.(type) {
+		case string:
+			env.Dependencies = append(env.Dependencies, dep)
+		case map[interface{}]interface{}:
+			pip, ok := dep["pip"]
+			if !ok || len(dep) != 1 {
+				return nil, fmt.Errorf("%s: unsupported dependency section %v, only pip is supported", filepath.Base(path), dep)
+			}
+			entries, ok := pip.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: the pip section must be a list", filepath.Base(path))
+			}
+			for _, entry := range entries {
+				requirement, ok := entry.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: pip requirement %v is not a string", filepath.Base(path), entry)
+				}
+				env.Pip = append(env.Pip, requirement)
+			}
+		default:
+			return nil, fmt.Errorf("%s: dependency %v is not a string", filepath.Base(path), dependency)
+		}
+	}
+
+	for _, file := range env.PipRequirementFiles() {
+		if exists, err := libbuildpack.FileExists(file); err != nil {
+			return nil, err
+		} else if !exists {
+			return nil, fmt.Errorf("%s: the pip section references %s, which does not exist", filepath.Base(path), file)
+		}
+	}
+
+	return env, nil
+}
+
+func validateChannel(channel string) error {
+	if strings.Contains(channel, "://") {
+		for _, scheme := range channelSchemes {
+			if strings.HasPrefix(channel, scheme) && len(channel) > len(scheme) {
+				return nil
+			}
+		}
+		return fmt.Errorf("channel %q is not a supported URL", channel)
+	}
+	if !channelNameRegex.MatchString(channel) {
+		return fmt.Errorf("channel %q is not a valid channel name", channel)
+	}
+	return nil
+}
+
+// PythonSpec returns the version spec of the python dependency, e.g.
+// "=3.11" for "python=3.11". found is false when python is not listed.
+func (e *Environment) PythonSpec() (spec string, found bool) {
+	for _, dependency := range e.Dependencies {
+		match := matchSpecNameRegex.FindStringSubmatch(strings.TrimSpace(dependency))
+		if match == nil {
+			continue
+		}
+		name := match[1]
+		if _, after, ok := strings.Cut(name, "::"); ok {
+			name = after
+		}
+		if strings.ToLower(name) == "python" {
+			return strings.TrimSpace(match[2]), true
+		}
+	}
+	return "", false
+}
+
+// PackageNames returns the names of the conda dependencies, without channel
+// and version spec.
+func (e *Environment) PackageNames() []string {
+	var names []string
+	for _, dependency := range e.Dependencies {
+		if match := matchSpecNameRegex.FindStringSubmatch(strings.TrimSpace(dependency)); match != nil {
+			name := match[1]
+			if _, after, ok := strings.Cut(name, "::"); ok {
+				name = after
+			}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// PipRequirementFiles returns the requirement files that the pip section
+// references with -r, relative to the directory of environment.yml.
+func (e *Environment) PipRequirementFiles() []string {
+	var files []string
+	for _, entry := range e.Pip {
+		fields := strings.Fields(entry)
+		if len(fields) == 2 && (fields[0] == "-r" || fields[0] == "--requirement") {
+			files = append(files, filepath.Join(filepath.Dir(e.Path), fields[1]))
+		} else if file, ok := strings.CutPrefix(entry, "--requirement="); ok {
+			files = append(files, filepath.Join(filepath.Dir(e.Path), strings.TrimSpace(file)))
+		}
+	}
+	return files
+}
+
+// SatisfiesPython reports whether a python version such as "3.11.4" or
+// "3.11.x" satisfies a conda version spec such as "=3.11", "3.11.*",
+// ">=3.10,<3.12" or "3.10|3.11".
+func SatisfiesPython(version, spec string) bool {
+	version = strings.TrimSuffix(strings.TrimSuffix(version, ".x"), ".*")
+	spec = strings.ReplaceAll(spec, " ", "")
+	if spec == "" || spec == "*" {
+		return true
+	}
+
+	for _, alternative := range strings.Split(spec, "|") {
+		satisfied := true
+		for _, constraint := range strings.Split(alternative, ",") {
+			if !satisfiesConstraint(version, constraint) {
+				satisfied = false
+				break
+			}
+		}
+		if satisfied {
+			return true
+		}
+	}
+	return false
+}
+
+func satisfiesConstraint(version, constraint string) bool {
+	for _, op := range []string{">=", "<=", "!=", "==", ">", "<", "~=", "="} {
+		if rest, ok := strings.CutPrefix(constraint, op); ok {
+			switch op {
+			case ">=":
+				return compareVersions(version, rest) >= 0
+			case "<=":
+				return compareVersions(version, rest) <= 0
+			case ">":
+				return compareVersions(version, rest) > 0
+			case "<":
+				return compareVersions(version, rest) < 0
+			case "!=":
+				return !matchesVersion(version, rest, false)
+			case "==":
+				return matchesVersion(version, rest, false)
+			case "~=":
+				prefix := rest
+				if i := strings.LastIndex(rest, "."); i >= 0 {
+					prefix = rest[:i]
+				}
+				return compareVersions(version, rest) >= 0 && matchesVersion(version, prefix, true)
+			default:
+				return matchesVersion(version, rest, true)
+			}
+		}
+	}
+	return matchesVersion(version, constraint, true)
+}
+
+// matchesVersion compares versions component by component. A trailing "*"
+// or a fuzzy match (conda's "=3.11") only compares the components of the
+// spec. The version may itself be a prefix such as "3.11" from
+// "python-3.11.x".
+func matchesVersion(version, spec string, fuzzy bool) bool {
+	if strings.HasSuffix(spec, "*") {
+		spec = strings.TrimSuffix(strings.TrimSuffix(spec, "*"), ".")
+		fuzzy = true
+	}
+	versionParts := strings.Split(version, ".")
+	specParts := strings.Split(spec, ".")
+	for i, part := range specParts {
+		if i >= len(versionParts) {
+			return true
+		}
+		if versionParts[i] != part {
+			return false
+		}
+	}
+	return fuzzy || len(versionParts) == len(specParts)
+}
+
+func compareVersions(a, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		x, errX := strconv.Atoi(aParts[i])
+		y, errY := strconv.Atoi(bParts[i])
+		if errX != nil || errY != nil {
+			if c := strings.Compare(aParts[i], bParts[i]); c != 0 {
+				return c
+			}
+			continue
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Validate checks environment.yml and its python pin against runtime.txt.
+// Apps that only ship a lock file have nothing to validate.
+func (c *Conda) Validate() error {
+	envPath := filepath.Join(c.Stager.BuildDir(), "environment.yml")
+	if exists, err := libbuildpack.FileExists(envPath); err != nil {
+		return err
+	} else if !exists {
+		return nil
+	}
+
+	env, err := LoadEnvironment(envPath)
+	if err != nil {
+		return err
+	}
+
+	if len(env.Pip) > 0 {
+		hasPip := false
+		for _, name := range env.PackageNames() {
+			if name == "pip" {
+				hasPip = true
+			}
+		}
+		if !hasPip {
+			c.Log.Warning("environment.yml has a pip section but does not list pip as a dependency. Add pip to the dependencies to get a predictable pip version")
+		}
+	}
+
+	runtimePath := filepath.Join(c.Stager.BuildDir(), "runtime.txt")
+	if exists, err := libbuildpack.FileExists(runtimePath); err != nil {
+		return err
+	} else if !exists {
+		return nil
+	}
+
+	contents, err := os.ReadFile(runtimePath)
+	if err != nil {
+		return err
+	}
+	runtimeVersion := strings.TrimPrefix(strings.TrimSpace(string(contents)), "python-")
+
+	spec, pinned := env.PythonSpec()
+	if !pinned || spec == "" {
+		c.Log.Warning("runtime.txt is ignored for apps with environment.yml. Pin the Python version in environment.yml instead, e.g. 'python=%s'", runtimeVersion)
+		return nil
+	}
+
+	if !SatisfiesPython(runtimeVersion, spec) {
+		return fmt.Errorf("runtime.txt requests python %s, but environment.yml pins python%s. Remove runtime.txt or make the two versions agree", runtimeVersion, spec)
+	}
+
+	c.Log.Warning("you have specified the version of Python runtime both in 'runtime.txt' and 'environment.yml'. You should remove one of the two versions")
+	return nil
+}
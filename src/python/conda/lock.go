@@ -0,0 +1,209 @@
+package conda
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+const (
+	EnvCondaLockFile = "BP_CONDA_LOCK_FILE"
+
+	// The platform of the Cloud Foundry stacks
+	lockPlatform = "linux-64"
+)
+
+// Explicit spec files are looked up by these names, in this order, unless
+// BP_CONDA_LOCK_FILE names one. bin/detect checks for the same files.
+var explicitLockFiles = []string{"conda-" + lockPlatform + ".lock", "explicit-" + lockPlatform + ".txt"}
+
+// LockFile is a fully resolved conda environment that can be installed
+// without solving.
+type LockFile struct {
+	// Path is the lock file in the app
+	Path string
+	// Explicit is an @EXPLICIT spec with a hash for every package
+	Explicit []string
+	// Pip are requirements with hashes for packages installed by pip
+	Pip []string
+}
+
+type condaLockYml struct {
+	Package []struct {
+		Name     string `yaml:"name"`
+		Version  string `yaml:"version"`
+		Manager  string `yaml:"manager"`
+		Platform string `yaml:"platform"`
+		URL      string `yaml:"url"`
+		Hash     struct {
+			MD5    string `yaml:"md5"`
+			SHA256 string `yaml:"sha256"`
+		} `yaml:"hash"`
+	} `yaml:"package"`
+}
+
+// HasEnvironment reports whether the app describes a conda environment, with
+// environment.yml or any supported lock file.
+func HasEnvironment(buildDir string) (bool, error) {
+	names := append([]string{"environment.yml", "conda-lock.yml"}, explicitLockFiles...)
+	if name := os.Getenv(EnvCondaLockFile); name != "" {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if exists, err := libbuildpack.FileExists(filepath.Join(buildDir, name)); err != nil {
+			return false, err
+		} else if exists {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// FindLockFile returns the lock file of the app, or nil when there is none.
+// Per-platform explicit spec files are preferred over conda-lock.yml.
+func (c *Conda) FindLockFile() (*LockFile, error) {
+	candidates := explicitLockFiles
+	if name := os.Getenv(EnvCondaLockFile); name != "" {
+		candidates = []string{name}
+	}
+
+	for _, name := range candidates {
+		path := filepath.Join(c.Stager.BuildDir(), name)
+		if exists, err := libbuildpack.FileExists(path); err != nil {
+			return nil, err
+		} else if !exists {
+			if name == os.Getenv(EnvCondaLockFile) {
+				return nil, fmt.Errorf("%s %s does not exist", EnvCondaLockFile, name)
+			}
+			continue
+		}
+
+		if strings.HasSuffix(name, ".yml") || strings.HasSuffix(name, ".yaml") {
+			return parseCondaLockYml(path)
+		}
+		return parseExplicitLockFile(path)
+	}
+
+	path := filepath.Join(c.Stager.BuildDir(), "conda-lock.yml")
+	if exists, err := libbuildpack.FileExists(path); err != nil {
+		return nil, err
+	} else if exists {
+		return parseCondaLockYml(path)
+	}
+
+	return nil, nil
+}
+
+func parseExplicitLockFile(path string) (*LockFile, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &LockFile{Path: path}
+	explicit := false
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case line == "@EXPLICIT":
+			explicit = true
+		case !explicit:
+			return nil, fmt.Errorf("%s is not an explicit spec file: %q before @EXPLICIT", filepath.Base(path), line)
+		default:
+			if _, hash, found := strings.Cut(line, "#"); !found || hash == "" {
+				return nil, fmt.Errorf("%s has no hash for %s", filepath.Base(path), line)
+			}
+			lock.Explicit = append(lock.Explicit, line)
+		}
+	}
+
+	if !explicit {
+		return nil, fmt.Errorf("%s is not an explicit spec file: @EXPLICIT is missing", filepath.Base(path))
+	}
+	return lock, nil
+}
+
+func parseCondaLockYml(path string) (*LockFile, error) {
+	var lockYml condaLockYml
+	if err := libbuildpack.NewYAML().Load(path, &lockYml); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", filepath.Base(path), err)
+	}
+
+	lock := &LockFile{Path: path}
+	for _, pkg := range lockYml.Package {
+		if pkg.Platform != lockPlatform {
+			continue
+		}
+
+		switch pkg.Manager {
+		case "conda":
+			switch {
+			case pkg.Hash.MD5 != "":
+				lock.Explicit = append(lock.Explicit, fmt.Sprintf("%s#%s", pkg.URL, pkg.Hash.MD5))
+			case pkg.Hash.SHA256 != "":
+				lock.Explicit = append(lock.Explicit, fmt.Sprintf("%s#sha256:%s", pkg.URL, pkg.Hash.SHA256))
+			default:
+				return nil, fmt.Errorf("%s has no hash for %s %s", filepath.Base(path), pkg.Name, pkg.Version)
+			}
+		case "pip":
+			if pkg.Hash.SHA256 == "" {
+				return nil, fmt.Errorf("%s has no sha256 hash for pip package %s %s", filepath.Base(path), pkg.Name, pkg.Version)
+			}
+			lock.Pip = append(lock.Pip, fmt.Sprintf("%s @ %s --hash=sha256:%s", pkg.Name, pkg.URL, pkg.Hash.SHA256))
+		default:
+			return nil, fmt.Errorf("%s has an unknown manager %q for %s", filepath.Base(path), pkg.Manager, pkg.Name)
+		}
+	}
+
+	if len(lock.Explicit) == 0 {
+		return nil, fmt.Errorf("%s has no packages for %s", filepath.Base(path), lockPlatform)
+	}
+	return lock, nil
+}
+
+// InstallLockFile creates the environment from the locked packages without
+// solving. conda verifies the hash of every package it downloads, pip runs
+// in hash-checking mode.
+func (c *Conda) InstallLockFile(lock *LockFile, verbosity []string) error {
+	c.Log.BeginStep("Installing conda environment from %s", filepath.Base(lock.Path))
+
+	specDir, err := os.MkdirTemp("", "conda-lock")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(specDir)
+
+	explicitPath := filepath.Join(specDir, "explicit.txt")
+	if err := os.WriteFile(explicitPath, []byte("@EXPLICIT\n"+strings.Join(lock.Explicit, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+
+	args := append(append([]string{"create", "--yes"}, verbosity...), "-n", "dep_env", "--file", explicitPath)
+	c.Log.Debug("Run Conda: %s %s", c.condaExec(), strings.Join(args, " "))
+	if err := c.Command.Execute("/", indentWriter(os.Stdout), indentWriter(os.Stderr), c.condaExec(), args...); err != nil {
+		return fmt.Errorf("Could not run %s create: %v", filepath.Base(c.condaExec()), err)
+	}
+
+	if len(lock.Pip) == 0 {
+		return nil
+	}
+
+	pipRequirements := filepath.Join(specDir, "requirements.txt")
+	if err := os.WriteFile(pipRequirements, []byte(strings.Join(lock.Pip, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+
+	c.Log.BeginStep("Installing pip packages from %s", filepath.Base(lock.Path))
+	if err := c.Command.Execute("/", indentWriter(os.Stdout), indentWriter(os.Stderr), c.Python(), "-m", "pip", "install", "--no-deps", "--require-hashes", "-r", pipRequirements); err != nil {
+		return fmt.Errorf("Could not install pip packages: %v", err)
+	}
+	return nil
+}
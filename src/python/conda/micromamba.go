@@ -0,0 +1,106 @@
+package conda
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+const (
+	EnvCondaBackend = "BP_CONDA_BACKEND"
+
+	BackendConda      = "conda"
+	BackendMicromamba = "micromamba"
+)
+
+// Backend returns the tool that creates the environment: the Miniforge
+// distribution of conda (the default) or a standalone micromamba binary.
+func (c *Conda) Backend() (string, error) {
+	switch backend := strings.ToLower(strings.TrimSpace(os.Getenv(EnvCondaBackend))); backend {
+	case "", BackendConda, "miniforge":
+		return BackendConda, nil
+	case BackendMicromamba:
+		return BackendMicromamba, nil
+	default:
+		return "", fmt.Errorf("%s must be %s or %s, got %q", EnvCondaBackend, BackendConda, BackendMicromamba, backend)
+	}
+}
+
+func (c *Conda) isMicromamba() bool {
+	backend, _ := c.Backend()
+	return backend == BackendMicromamba
+}
+
+// installMicromamba puts the micromamba binary into the bin directory of the
+// root prefix. Environments are created below the same prefix as with conda,
+// so the interpreter is found at the same path. The dependency is either a
+// release tarball with bin/micromamba or the bare binary.
+func (c *Conda) installMicromamba(version string) error {
+	c.Log.BeginStep("Supplying micromamba")
+	downloadDir, err := os.MkdirTemp("", "micromamba")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(downloadDir)
+
+	if err := c.Installer.InstallOnlyVersion(version, downloadDir); err != nil {
+		return fmt.Errorf("Error downloading micromamba: %v", err)
+	}
+
+	binary, err := findMicromamba(downloadDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.condaBin(), 0755); err != nil {
+		return err
+	}
+	if err := libbuildpack.CopyFile(binary, c.condaExec()); err != nil {
+		return err
+	}
+	if err := os.Chmod(c.condaExec(), 0755); err != nil {
+		return err
+	}
+
+	if err := c.Command.Execute("/", indentWriter(os.Stdout), io.Discard, c.condaExec(), "--version"); err != nil {
+		return fmt.Errorf("Error running micromamba: %v", err)
+	}
+
+	return nil
+}
+
+func findMicromamba(downloadDir string) (string, error) {
+	binary := filepath.Join(downloadDir, "bin", "micromamba")
+	if exists, err := libbuildpack.FileExists(binary); err != nil {
+		return "", err
+	} else if exists {
+		return binary, nil
+	}
+
+	files, err := os.ReadDir(downloadDir)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 1 && files[0].Type().IsRegular() {
+		return filepath.Join(downloadDir, files[0].Name()), nil
+	}
+	return "", errors.New("the micromamba dependency has no bin/micromamba")
+}
+
+// micromambaProfileD activates dep_env the way "source activate" does, as
+// micromamba does not ship the conda shell functions.
+func (c *Conda) micromambaProfileD() string {
+	return fmt.Sprintf(`grep -rlI %s $DEPS_DIR/%s/conda | xargs sed -i -e "s|%s|$DEPS_DIR/%s|g"
+export MAMBA_ROOT_PREFIX="$DEPS_DIR/%s/conda"
+export CONDA_PREFIX="$MAMBA_ROOT_PREFIX/envs/dep_env"
+export CONDA_DEFAULT_ENV=dep_env
+export PATH="$CONDA_PREFIX/bin:$PATH"
+for script in "$CONDA_PREFIX"/etc/conda/activate.d/*.sh; do
+  [ -f "$script" ] && . "$script"
+done
+`, c.Stager.DepDir(), c.Stager.DepsIdx(), c.Stager.DepDir(), c.Stager.DepsIdx(), c.Stager.DepsIdx())
+}
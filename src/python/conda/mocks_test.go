@@ -5,6 +5,7 @@
 package conda_test
 
 import (
+	libbuildpack "github.com/cloudfoundry/libbuildpack"
 	gomock "github.com/golang/mock/gomock"
 	io "io"
 	reflect "reflect"
@@ -117,6 +118,44 @@ func (mr *MockStagerMockRecorder) WriteProfileD(arg0, arg1 interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteProfileD", reflect.TypeOf((*MockStager)(nil).WriteProfileD), arg0, arg1)
 }
 
+// MockManifest is a mock of Manifest interface
+type MockManifest struct {
+	ctrl     *gomock.Controller
+	recorder *MockManifestMockRecorder
+}
+
+// MockManifestMockRecorder is the mock recorder for MockManifest
+type MockManifestMockRecorder struct {
+	mock *MockManifest
+}
+
+// NewMockManifest creates a new mock instance
+func NewMockManifest(ctrl *gomock.Controller) *MockManifest {
+	mock := &MockManifest{ctrl: ctrl}
+	mock.recorder = &MockManifestMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockManifest) EXPECT() *MockManifestMockRecorder {
+	return m.recorder
+}
+
+// DefaultVersion mocks base method
+func (m *MockManifest) DefaultVersion(arg0 string) (libbuildpack.Dependency, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DefaultVersion", arg0)
+	ret0, _ := ret[0].(libbuildpack.Dependency)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DefaultVersion indicates an expected call of DefaultVersion
+func (mr *MockManifestMockRecorder) DefaultVersion(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DefaultVersion", reflect.TypeOf((*MockManifest)(nil).DefaultVersion), arg0)
+}
+
 // MockInstaller is a mock of Installer interface
 type MockInstaller struct {
 	ctrl     *gomock.Controller
@@ -6,7 +6,7 @@ import (
 	"time"
 
 	"github.com/cloudfoundry/python-buildpack/src/python/finalize"
-	_ "github.com/cloudfoundry/python-buildpack/src/python/hooks"
+	"github.com/cloudfoundry/python-buildpack/src/python/hooks"
 	"github.com/cloudfoundry/python-buildpack/src/python/pyfinder"
 	"github.com/cloudfoundry/python-buildpack/src/python/requirements"
 
@@ -56,7 +56,7 @@ func main() {
 		Logfile:        logfile,
 		Command:        &libbuildpack.Command{},
 		ManagePyFinder: pyfinder.ManagePyFinder{},
-		Requirements:   requirements.Reqs{},
+		Requirements:   requirements.Reqs{Log: logger},
 	}
 
 	if err := finalize.Run(&f); err != nil {
@@ -68,6 +68,11 @@ func main() {
 		os.Exit(13)
 	}
 
+	if err := (hooks.AppHookRunner{Stager: stager}).Run(hooks.PreReleaseHook); err != nil {
+		logger.Error("Pre Release: %s", err.Error())
+		os.Exit(15)
+	}
+
 	if err := stager.SetLaunchEnvironment(); err != nil {
 		logger.Error("Unable to setup launch environment: %s", err.Error())
 		os.Exit(14)
@@ -2,22 +2,25 @@ package hooks
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"sort"
-	"strings"
-
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/python-buildpack/src/python/services"
+	"github.com/cloudfoundry/python-buildpack/src/python/supply"
 )
 
-const (
-	appDynamicsServiceNameRegex = "app(-)?dynamics"
-)
+// Services labelled or named like this, including user-provided ones,
+// configure the Appdynamics agent.
+var appDynamicsServiceMatcher = services.Matcher{
+	NamePattern: regexp.MustCompile("app(-)?dynamics"),
+	Types:       []string{"appdynamics"},
+}
 
 type Command interface {
 	Execute(string, io.Writer, io.Writer, string, ...string) error
@@ -30,123 +33,67 @@ type AppdynamicsHook struct {
 }
 
 type Plan struct {
-	Credentials Credential `json:"credentials"`
-	Name        string     `json:"name,omitempty"`
+	Credentials Credential
+	Name        string
 }
 
 type Credential struct {
-	ControllerHost   string `json:"host-name"`
-	ControllerPort   string `json:"port"`
-	SslEnabled       bool   `json:"ssl-enabled"`
-	AccountAccessKey string `json:"account-access-key"`
-	AccountName      string `json:"account-name"`
+	ControllerHost      string
+	ControllerPort      int
+	SslEnabled          bool
+	AccountAccessKey    string
+	AccountName         string
+	ApplicationName     string
+	TierName            string
+	NodeName            string
+	AgentVersion        string
+	ProxyHost           string
+	ProxyPort           int
+	ProxyUser           string
+	ProxyPassword       string
+	AnalyticsHost       string
+	AnalyticsPort       int
+	AnalyticsSslEnabled bool
 }
 
 type VcapApplication struct {
-	ApplicationName string `json:"application_name"`
-	Name            string `json:"name"`
-	ProcessType     string `json:"process_type"`
-	Limits          struct {
+	ApplicationName    string `json:"application_name"`
+	ApplicationVersion string `json:"application_version"`
+	Name               string `json:"name"`
+	SpaceName          string `json:"space_name"`
+	ProcessType        string `json:"process_type"`
+	Limits             struct {
 		Mem int `json:"mem"`
 	} `json:"limits"`
 }
 
-func (h AppdynamicsHook) getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
-	}
-	return fallback
-}
-
-func (h AppdynamicsHook) GenerateAppdynamicsScript(envVars map[string]string) string {
-	var envKeys []string
-	for k := range envVars {
-		envKeys = append(envKeys, k)
-	}
-	sort.Strings(envKeys) // unnecessary but just to be deterministic for tests
-
-	scriptContents := "# Autogenerated Appdynamics Script\n"
-	for _, envKey := range envKeys {
-		envStr := fmt.Sprintf("export %s=%s", envKey, envVars[envKey])
-		scriptContents += "\n" + envStr
-	}
-	return scriptContents
+// vcapApplication returns VCAP_APPLICATION, or an empty application when it
+// is not set.
+func vcapApplication() VcapApplication {
+	application := VcapApplication{}
+	_ = json.Unmarshal([]byte(os.Getenv("VCAP_APPLICATION")), &application)
+	return application
 }
 
 func (h AppdynamicsHook) GenerateStartUpCommand(startCommand string) (string, error) {
-	webCommands := strings.SplitN(startCommand, ":", 2)
-	if len(webCommands) != 2 {
-		return "", errors.New("improper format found in Procfile")
-	}
-	return fmt.Sprintf("web: pyagent run -- %s", webCommands[1]), nil
+	return wrapProcfile(startCommand, "pyagent run --")
 }
 
 func (h AppdynamicsHook) RewriteProcFile(procFilePath string) error {
-	startCommand, err := os.ReadFile(procFilePath)
-	if err != nil {
-		return fmt.Errorf("Error reading file %s: %v", procFilePath, err)
-	}
-	newCommand, err := h.GenerateStartUpCommand(string(startCommand))
-	if err != nil {
-		return err
-	}
-
-	if err := os.WriteFile(procFilePath, []byte(newCommand), 0666); err != nil {
-		return fmt.Errorf("Error writing file %s: %v", procFilePath, err)
-	}
-	return nil
-}
-
-func (h AppdynamicsHook) RewriteRequirementsFile(stager *libbuildpack.Stager) error {
-	h.Log.BeginStep("Rewriting Requirements file with appdynamics package")
-
-	reqFile := filepath.Join(stager.BuildDir(), "requirements.txt")
-	writeFlag := os.O_APPEND | os.O_WRONLY
-	packageName := "\n" + "appdynamics"
-
-	if exists, err := libbuildpack.FileExists(reqFile); err != nil {
-		return err
-	} else if !exists {
-		h.Log.Info("Requirements file not found creating one with appdynamics packages")
-		writeFlag = os.O_CREATE | os.O_WRONLY
-		packageName = "appdynamics"
-	}
-
-	f, err := os.OpenFile(reqFile, writeFlag, 0666)
-	if err != nil {
-		panic(err)
-	}
-
-	defer f.Close()
-
-	if _, err = f.WriteString(packageName); err != nil {
-		panic(err)
-	}
-	fileContents, _ := os.ReadFile(f.Name())
-	h.Log.Info("%s", string(fileContents))
-
-	return nil
+	return rewriteProcfile(procFilePath, "pyagent run --")
 }
 
 func (h AppdynamicsHook) RewriteProcFileWithAppdynamics(stager *libbuildpack.Stager) error {
-	h.Log.BeginStep("Rewriting ProcFile to start with Appdynamics")
-
-	file := filepath.Join(stager.BuildDir(), "Procfile")
-
-	if exists, _ := libbuildpack.FileExists(file); exists {
-		if err := h.RewriteProcFile(file); err != nil {
-			return err
-		}
-		fileContents, _ := os.ReadFile(file)
-		h.Log.Info("%s", string(fileContents))
-	} else {
-		h.Log.Info("Cannot find Procfile, skipping this step!")
-	}
-	return nil
+	return wrapAgentProcesses(h.Log, stager, "pyagent run --")
 }
 
-func (h AppdynamicsHook) CreateAppDynamicsEnv(stager *libbuildpack.Stager, environmentVars map[string]string) error {
-	scriptContents := h.GenerateAppdynamicsScript(environmentVars)
+// CreateAppDynamicsEnv writes the agent settings to profile.d. Each instance
+// reports as its own node, named after the instance index.
+func (h AppdynamicsHook) CreateAppDynamicsEnv(stager *libbuildpack.Stager, environmentVars map[string]string, nodeName string) error {
+	scriptContents := generateProfileScript("Appdynamics", environmentVars)
+	if nodeName != "" {
+		scriptContents += fmt.Sprintf("export APPD_NODE_NAME=${APPD_NODE_NAME:-%s-${CF_INSTANCE_INDEX:-0}}\n", shellQuote(nodeName))
+	}
 	h.Log.BeginStep("Writing Appdynamics Environment")
 	h.Log.Debug("%s", scriptContents)
 	return stager.WriteProfileD("appdynamics.sh", scriptContents)
@@ -158,59 +105,42 @@ func (h AppdynamicsHook) BeforeCompile(stager *libbuildpack.Stager) error {
 		return nil
 	}
 
-	// Some env var or something that lets us know that we are using app dynamics?
-
-	vcapServices := os.Getenv("VCAP_SERVICES")
-	services := make(map[string][]Plan)
-
-	err := json.Unmarshal([]byte(vcapServices), &services)
+	resolver, err := services.NewResolver()
 	if err != nil {
-		h.Log.Debug("Could not unmarshall VCAP_SERVICES JSON exiting: %v", err)
+		h.Log.Debug("Could not load service bindings, exiting: %v", err)
 		return nil
 	}
 
-	appdServiceName, appdynamicsPlan, err := getAppDynamicsServiceName(services, h.Log)
-
-	if appdServiceName == "" {
+	service, found, err := resolver.Find(appDynamicsServiceMatcher)
+	if err != nil {
+		h.Log.Error("Could not select the Appdynamics service: %v", err)
+		return err
+	} else if !found {
 		return nil
 	}
+	logDeprecationWarning(h.Log)
 
-	h.Log.BeginStep("Setting up Appdynamics")
-
-	vcapApplication := os.Getenv("VCAP_APPLICATION")
-	application := VcapApplication{}
-
-	err = json.Unmarshal([]byte(vcapApplication), &application)
+	appdynamicsPlan, err := newAppDynamicsPlan(service)
 	if err != nil {
-		h.Log.Debug("Could not unmarshall VCAP_APPLICATION JSON %v", err)
-		h.Log.Debug("VCAP_APPLICATION: %s", vcapApplication)
-	}
-
-	sslFlag := "off"
-
-	credentials := appdynamicsPlan.Credentials
-
-	if credentials.SslEnabled {
-		sslFlag = "on"
+		h.Log.Error("Invalid Appdynamics service %s: %v", service.DisplayName(), err)
+		return err
 	}
 
-	appdEnv := map[string]string{
-		"APPD_APP_NAME":           h.getEnv("APPD_APP_NAME", application.ApplicationName),
-		"APPD_TIER_NAME":          h.getEnv("APPD_TIER_NAME", application.ApplicationName),
-		"APPD_NODE_NAME":          h.getEnv("APPD_NODE_NAME", application.ApplicationName),
-		"APPD_CONTROLLER_HOST":    credentials.ControllerHost,
-		"APPD_CONTROLLER_PORT":    credentials.ControllerPort,
-		"APPD_ACCOUNT_ACCESS_KEY": credentials.AccountAccessKey,
-		"APPD_ACCOUNT_NAME":       credentials.AccountName,
-		"APPD_SSL_ENABLED":        sslFlag,
-	}
+	h.Log.BeginStep("Setting up Appdynamics")
 
-	if err := h.RewriteRequirementsFile(stager); err != nil {
-		h.Log.Error("Could not write requirements file with Appdynamics packages: %v", err)
+	appdEnv, nodeName, err := h.Environment(stager, appdynamicsPlan.Credentials)
+	if err != nil {
+		h.Log.Error("Could not configure Appdynamics: %v", err)
 		return err
 	}
 
-	if err := h.CreateAppDynamicsEnv(stager, appdEnv); err != nil {
+	supply.AddExtraPackage(supply.ExtraPackage{
+		Name:    "appdynamics",
+		Version: appdynamicsPlan.Credentials.AgentVersion,
+		Source:  "Appdynamics",
+	})
+
+	if err := h.CreateAppDynamicsEnv(stager, appdEnv, nodeName); err != nil {
 		h.Log.Error("Could not create Appdynamics environment: %v", err)
 		return err
 	}
@@ -223,41 +153,132 @@ func (h AppdynamicsHook) BeforeCompile(stager *libbuildpack.Stager) error {
 	return nil
 }
 
-func getAppDynamicsServiceName(services map[string][]Plan, log *libbuildpack.Logger) (string, Plan, error) {
-	// Check if there is a service with name appdynamics or app-dynamics
-	for serviceName, servicePlans := range services {
-		if isAppDynamicsServiceName(serviceName) {
-			appdServiceName := serviceName
-			logDeprecationWarning(log)
-			return appdServiceName, servicePlans[0], nil
-		}
+// Environment returns the APPD_* settings of the agent and the prefix of its
+// node names. When the app has an appdynamics.cfg the agent is configured by
+// that file alone.
+func (h AppdynamicsHook) Environment(stager *libbuildpack.Stager, credentials Credential) (map[string]string, string, error) {
+	if exists, err := libbuildpack.FileExists(filepath.Join(stager.BuildDir(), "appdynamics.cfg")); err != nil {
+		return nil, "", err
+	} else if exists {
+		h.Log.Info("Using appdynamics.cfg of the app")
+		return map[string]string{"APPD_CONFIG_FILE": runtimePath("$HOME", "appdynamics.cfg")}, "", nil
+	}
+
+	application := vcapApplication()
+	appName := credentials.ApplicationName
+	if appName == "" {
+		appName = application.ApplicationName
+	}
+	tierName := credentials.TierName
+	if tierName == "" {
+		tierName = application.ApplicationName
+	}
+	nodeName := credentials.NodeName
+	if nodeName == "" {
+		nodeName = tierName
+	}
+
+	env := map[string]string{
+		"APPD_APP_NAME":           appName,
+		"APPD_TIER_NAME":          tierName,
+		"APPD_CONTROLLER_HOST":    credentials.ControllerHost,
+		"APPD_ACCOUNT_ACCESS_KEY": credentials.AccountAccessKey,
+		"APPD_ACCOUNT_NAME":       credentials.AccountName,
+		"APPD_SSL_ENABLED":        onOff(credentials.SslEnabled),
+	}
+	if credentials.ControllerPort != 0 {
+		env["APPD_CONTROLLER_PORT"] = strconv.Itoa(credentials.ControllerPort)
 	}
 
-	// If this line is reached, no service with name appdynamics or app-dynamics was found. Check for user-provided services
-	userProvidedServices, keyExists := services["user-provided"]
-	if !keyExists {
-		return "", Plan{}, nil
+	if credentials.ProxyHost != "" {
+		env["APPD_HTTP_PROXY_HOST"] = credentials.ProxyHost
+		if credentials.ProxyPort != 0 {
+			env["APPD_HTTP_PROXY_PORT"] = strconv.Itoa(credentials.ProxyPort)
+		}
+		if credentials.ProxyUser != "" {
+			env["APPD_HTTP_PROXY_USER"] = credentials.ProxyUser
+		}
+		if credentials.ProxyPassword != "" {
+			passwordFile, err := writeSecretFile(stager, "appdynamics", "proxy-password", credentials.ProxyPassword)
+			if err != nil {
+				return nil, "", err
+			}
+			env["APPD_HTTP_PROXY_PASSWORD_FILE"] = passwordFile
+		}
 	}
 
-	for _, plan := range userProvidedServices {
-		if isAppDynamicsServiceName(plan.Name) {
-			appdServiceName := plan.Name
-			logDeprecationWarning(log)
-			return appdServiceName, plan, nil
+	if credentials.AnalyticsHost != "" {
+		env["APPD_ANALYTICS_HOST"] = credentials.AnalyticsHost
+		if credentials.AnalyticsPort != 0 {
+			env["APPD_ANALYTICS_PORT"] = strconv.Itoa(credentials.AnalyticsPort)
 		}
+		env["APPD_ANALYTICS_SSL_ENABLED"] = onOff(credentials.AnalyticsSslEnabled)
+	}
+	return env, nodeName, nil
+}
+
+func newAppDynamicsPlan(service services.Service) (Plan, error) {
+	credentials := Credential{
+		ControllerHost:   service.Credential("host-name"),
+		AccountAccessKey: service.Credential("account-access-key"),
+		AccountName:      service.Credential("account-name"),
+		ApplicationName:  service.Credential("application-name"),
+		TierName:         service.Credential("tier-name"),
+		NodeName:         service.Credential("node-name"),
+		AgentVersion:     service.Credential("agent-version"),
+		ProxyHost:        service.Credential("proxy-host"),
+		ProxyUser:        service.Credential("proxy-user"),
+		ProxyPassword:    service.Credential("proxy-password"),
+		AnalyticsHost:    service.Credential("analytics-host"),
 	}
 
-	// If this line is reached, no service with name appdynamics or app-dynamics was found in either the services and user-provided services. Return empty string, empty plan and nil error
-	return "", Plan{}, nil
+	var err error
+	if credentials.ControllerPort, err = portCredential(service, "port"); err != nil {
+		return Plan{}, err
+	}
+	if credentials.ProxyPort, err = portCredential(service, "proxy-port"); err != nil {
+		return Plan{}, err
+	}
+	if credentials.AnalyticsPort, err = portCredential(service, "analytics-port"); err != nil {
+		return Plan{}, err
+	}
+	if credentials.SslEnabled, err = boolCredential(service, "ssl-enabled"); err != nil {
+		return Plan{}, err
+	}
+	if credentials.AnalyticsSslEnabled, err = boolCredential(service, "analytics-ssl-enabled"); err != nil {
+		return Plan{}, err
+	}
+	return Plan{Name: service.Name, Credentials: credentials}, nil
 }
 
-func isAppDynamicsServiceName(serviceName string) bool {
-	match, err := regexp.MatchString(appDynamicsServiceNameRegex, serviceName)
-	if err != nil {
-		return false
+func portCredential(service services.Service, key string) (int, error) {
+	value := service.Credential(key)
+	if value == "" {
+		return 0, nil
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%s must be a port number, got %q", key, value)
 	}
+	return port, nil
+}
 
-	return match
+func boolCredential(service services.Service, key string) (bool, error) {
+	switch value := strings.ToLower(service.Credential(key)); value {
+	case "", "false", "off", "no":
+		return false, nil
+	case "true", "on", "yes":
+		return true, nil
+	default:
+		return false, fmt.Errorf("%s must be true or false, got %q", key, value)
+	}
+}
+
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
 }
 
 func logDeprecationWarning(log *libbuildpack.Logger) {
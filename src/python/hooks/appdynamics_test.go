@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/cloudfoundry/python-buildpack/src/python/hooks"
+	"github.com/cloudfoundry/python-buildpack/src/python/supply"
 
 	"path/filepath"
 
@@ -42,6 +43,8 @@ var _ = Describe("Appdynamics", func() {
 
 		args := []string{buildDir, "", depsDir, buildOrder}
 		stager = libbuildpack.NewStager(args, logger, &libbuildpack.Manifest{})
+		supply.ClearExtraPackages()
+		DeferCleanup(supply.ClearExtraPackages)
 
 		command := &libbuildpack.Command{}
 
@@ -55,10 +58,27 @@ var _ = Describe("Appdynamics", func() {
 		It("Returns the command when it is provided in the correct format", func() {
 			startCommand := "web: python flask.py"
 			ModifiedCommand, err := appdynamics.GenerateStartUpCommand(startCommand)
-			Expect(ModifiedCommand).To(Equal("web: pyagent run --  python flask.py"))
+			Expect(ModifiedCommand).To(Equal("web: pyagent run -- python flask.py"))
 			Expect(err).NotTo(HaveOccurred())
 		})
 
+		It("Keeps the other processes and comments of the Procfile", func() {
+			startCommand := "# app\nweb: gunicorn app:app\nworker: celery -A app worker\n"
+			ModifiedCommand, err := appdynamics.GenerateStartUpCommand(startCommand)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ModifiedCommand).To(Equal("# app\nweb: pyagent run -- gunicorn app:app\nworker: celery -A app worker\n"))
+		})
+
+		It("Wraps the process types in BP_AGENT_PROCESS_TYPES", func() {
+			DeferCleanup(os.Setenv, "BP_AGENT_PROCESS_TYPES", os.Getenv("BP_AGENT_PROCESS_TYPES"))
+			os.Setenv("BP_AGENT_PROCESS_TYPES", "web,worker")
+
+			startCommand := "web: gunicorn app:app\nworker: celery -A app worker"
+			ModifiedCommand, err := appdynamics.GenerateStartUpCommand(startCommand)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ModifiedCommand).To(Equal("web: pyagent run -- gunicorn app:app\nworker: pyagent run -- celery -A app worker"))
+		})
+
 		It("Returns an error when provided the wrong format", func() {
 			startCommand := "python flask.py"
 			_, err := appdynamics.GenerateStartUpCommand(startCommand)
@@ -85,7 +105,7 @@ var _ = Describe("Appdynamics", func() {
 			Expect(err).NotTo(HaveOccurred())
 			startCommand, err := os.ReadFile(filepath.Join(tempProcDir, "Procfile"))
 			Expect(err).NotTo(HaveOccurred())
-			Expect(string(startCommand)).To(Equal("web: pyagent run --  python app.py"))
+			Expect(string(startCommand)).To(Equal("web: pyagent run -- python app.py"))
 		})
 
 		It("Errors when Procfile doesn't exist", func() {
@@ -102,67 +122,20 @@ var _ = Describe("Appdynamics", func() {
 		})
 	})
 
-	Context("RewriteRequirementsFile when requirements.txt is not packaged", func() {
-		It("creates requirements.txt", func() {
-			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).ToNot(BeTrue())
-			err := appdynamics.RewriteRequirementsFile(stager)
-			Expect(err).NotTo(HaveOccurred())
-			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeTrue())
-			packagesList, err := os.ReadFile(filepath.Join(buildDir, "requirements.txt"))
-			Expect(err).NotTo(HaveOccurred())
-			Expect(string(packagesList)).To(Equal("appdynamics"))
-		})
-	})
-
-	Context("RewriteRequirementsFile when requirements.txt is packaged", func() {
-		BeforeEach(func() {
-			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).ToNot(BeTrue())
-			procFile := filepath.Join(buildDir, "requirements.txt")
-			f, err := os.OpenFile(procFile, os.O_CREATE|os.O_WRONLY, 0644)
-			Expect(err).NotTo(HaveOccurred())
-			defer f.Close()
-			_, err = f.WriteString("Flask")
-			Expect(err).NotTo(HaveOccurred())
-			DeferCleanup(os.Remove, filepath.Join(buildDir, "requirements.txt"))
-		})
-
-		It("rewrites requirements.txt", func() {
-			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeTrue())
-			err := appdynamics.RewriteRequirementsFile(stager)
-			Expect(err).NotTo(HaveOccurred())
-			packages, err := os.ReadFile(filepath.Join(buildDir, "requirements.txt"))
-			Expect(string(packages)).To(Equal("Flask\nappdynamics"))
-		})
-	})
-
-	Context("GenerateAppdynamicsScript", func() {
-		It("Generates script from Env map", func() {
-			envVal := map[string]string{
-				"APPD_KEY_1": "APPD_VAL_1",
-				"APPD_KEY_2": "APPD_VAL_2",
-			}
-			script := appdynamics.GenerateAppdynamicsScript(envVal)
-			expectedScript := `# Autogenerated Appdynamics Script
-
-export APPD_KEY_1=APPD_VAL_1
-export APPD_KEY_2=APPD_VAL_2`
-			Expect(script).To(Equal(expectedScript))
-		})
-	})
-
 	Context("CreateAppDynamicsEnv", func() {
 		It("Generates script from Env map", func() {
 			envVal := map[string]string{
 				"APPD_KEY_1": "APPD_VAL_1",
 				"APPD_KEY_2": "APPD_VAL_2",
 			}
-			appdynamics.CreateAppDynamicsEnv(stager, envVal)
+			Expect(appdynamics.CreateAppDynamicsEnv(stager, envVal, "web")).To(Succeed())
 			appdynamicsShellScript := filepath.Join(stager.DepDir(), "profile.d", "appdynamics.sh")
-			Expect(libbuildpack.FileExists(appdynamicsShellScript)).To(BeTrue())
 			expectedScript := `# Autogenerated Appdynamics Script
 
-export APPD_KEY_1=APPD_VAL_1
-export APPD_KEY_2=APPD_VAL_2`
+export APPD_KEY_1=${APPD_KEY_1:-'APPD_VAL_1'}
+export APPD_KEY_2=${APPD_KEY_2:-'APPD_VAL_2'}
+export APPD_NODE_NAME=${APPD_NODE_NAME:-'web'-${CF_INSTANCE_INDEX:-0}}
+`
 			script, err := os.ReadFile(appdynamicsShellScript)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(string(script)).To(Equal(expectedScript))
@@ -213,11 +186,10 @@ export APPD_KEY_2=APPD_VAL_2`
 		Context("BeforeCompile when VCAP_SERVICES has appdynamics", func() {
 			serviceName := serviceName
 			BeforeEach(func() {
+				DeferCleanup(os.Setenv, "VCAP_APPLICATION", os.Getenv("VCAP_APPLICATION"))
 				os.Setenv("VCAP_SERVICES",
 					`{"`+serviceName+`": [{"instance_name": "plan-instance", "tags": [], "name": "plan", "syslog_drain_url": null, "binding_name": null, "credentials": {"host-name": "controller.test.com", "plan-name": "plan", "guid": "guid", "plan-description": "plan", "ssl-enabled": false, "account-access-key": "key", "account-name": "account-name", "port": "7777"}, "label": "appdynamics"}]}`)
 				os.Setenv("VCAP_APPLICATION", `{"application_id": "applicationId", "name": "test",  "application_name": "test"}`)
-				os.Setenv("APPD_TIER_NAME", "tier")
-				os.Setenv("APPD_NODE_NAME", "node")
 
 				Expect(os.WriteFile(filepath.Join(buildDir, "Procfile"), []byte("web: python app.py"), 0644)).To(Succeed())
 				Expect(err).NotTo(HaveOccurred())
@@ -232,26 +204,89 @@ export APPD_KEY_2=APPD_VAL_2`
 				appdynamicsInfo, err := os.ReadFile(filepath.Join(stager.DepDir(), "profile.d", "appdynamics.sh"))
 				expectedInfo := `# Autogenerated Appdynamics Script
 
-export APPD_ACCOUNT_ACCESS_KEY=key
-export APPD_ACCOUNT_NAME=account-name
-export APPD_APP_NAME=test
-export APPD_CONTROLLER_HOST=controller.test.com
-export APPD_CONTROLLER_PORT=7777
-export APPD_NODE_NAME=node
-export APPD_SSL_ENABLED=off
-export APPD_TIER_NAME=tier`
+export APPD_ACCOUNT_ACCESS_KEY=${APPD_ACCOUNT_ACCESS_KEY:-'key'}
+export APPD_ACCOUNT_NAME=${APPD_ACCOUNT_NAME:-'account-name'}
+export APPD_APP_NAME=${APPD_APP_NAME:-'test'}
+export APPD_CONTROLLER_HOST=${APPD_CONTROLLER_HOST:-'controller.test.com'}
+export APPD_CONTROLLER_PORT=${APPD_CONTROLLER_PORT:-'7777'}
+export APPD_SSL_ENABLED=${APPD_SSL_ENABLED:-'off'}
+export APPD_TIER_NAME=${APPD_TIER_NAME:-'test'}
+export APPD_NODE_NAME=${APPD_NODE_NAME:-'test'-${CF_INSTANCE_INDEX:-0}}
+`
 				Expect(string(appdynamicsInfo)).To(Equal(expectedInfo))
 				Expect(err).NotTo(HaveOccurred())
 
-				Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeTrue())
-				packages, err := os.ReadFile(filepath.Join(buildDir, "requirements.txt"))
-				Expect(err).NotTo(HaveOccurred())
-				Expect(string(packages)).To(Equal("appdynamics"))
+				Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeFalse())
+				Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{{Name: "appdynamics", Source: "Appdynamics"}}))
 
 				procCommand, err := os.ReadFile(filepath.Join(buildDir, "Procfile"))
 				Expect(err).NotTo(HaveOccurred())
-				Expect(string(procCommand)).To(Equal("web: pyagent run --  python app.py"))
+				Expect(string(procCommand)).To(Equal("web: pyagent run -- python app.py"))
 			})
 		})
 	}
+
+	Context("BeforeCompile with the full set of credentials", func() {
+		var credentials string
+
+		BeforeEach(func() {
+			DeferCleanup(os.Setenv, "VCAP_APPLICATION", os.Getenv("VCAP_APPLICATION"))
+			DeferCleanup(os.Unsetenv, "VCAP_SERVICES")
+			os.Setenv("VCAP_APPLICATION", `{"application_name": "test"}`)
+			credentials = `"host-name": "controller.test.com", "port": 443, "ssl-enabled": true, "account-access-key": "key", "account-name": "account", "application-name": "shop", "tier-name": "frontend", "node-name": "fe", "agent-version": "24.1.0.6567", "proxy-host": "proxy.internal", "proxy-port": "3128", "proxy-user": "appd", "proxy-password": "s3cret", "analytics-host": "analytics.internal", "analytics-port": 9090, "analytics-ssl-enabled": "true"`
+			Expect(os.WriteFile(filepath.Join(buildDir, "Procfile"), []byte("web: python app.py\n"), 0644)).To(Succeed())
+		})
+
+		It("configures proxy, analytics and naming from the binding", func() {
+			os.Setenv("VCAP_SERVICES", `{"appdynamics": [{"name": "appd", "credentials": {`+credentials+`}}]}`)
+			Expect(appdynamics.BeforeCompile(stager)).To(Succeed())
+
+			Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{{Name: "appdynamics", Version: "24.1.0.6567", Source: "Appdynamics"}}))
+			script, err := os.ReadFile(filepath.Join(stager.DepDir(), "profile.d", "appdynamics.sh"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(script)).To(Equal(`# Autogenerated Appdynamics Script
+
+export APPD_ACCOUNT_ACCESS_KEY=${APPD_ACCOUNT_ACCESS_KEY:-'key'}
+export APPD_ACCOUNT_NAME=${APPD_ACCOUNT_NAME:-'account'}
+export APPD_ANALYTICS_HOST=${APPD_ANALYTICS_HOST:-'analytics.internal'}
+export APPD_ANALYTICS_PORT=${APPD_ANALYTICS_PORT:-'9090'}
+export APPD_ANALYTICS_SSL_ENABLED=${APPD_ANALYTICS_SSL_ENABLED:-'on'}
+export APPD_APP_NAME=${APPD_APP_NAME:-'shop'}
+export APPD_CONTROLLER_HOST=${APPD_CONTROLLER_HOST:-'controller.test.com'}
+export APPD_CONTROLLER_PORT=${APPD_CONTROLLER_PORT:-'443'}
+export APPD_HTTP_PROXY_HOST=${APPD_HTTP_PROXY_HOST:-'proxy.internal'}
+export APPD_HTTP_PROXY_PASSWORD_FILE=${APPD_HTTP_PROXY_PASSWORD_FILE:-"$DEPS_DIR/9/appdynamics/proxy-password"}
+export APPD_HTTP_PROXY_PORT=${APPD_HTTP_PROXY_PORT:-'3128'}
+export APPD_HTTP_PROXY_USER=${APPD_HTTP_PROXY_USER:-'appd'}
+export APPD_SSL_ENABLED=${APPD_SSL_ENABLED:-'on'}
+export APPD_TIER_NAME=${APPD_TIER_NAME:-'frontend'}
+export APPD_NODE_NAME=${APPD_NODE_NAME:-'fe'-${CF_INSTANCE_INDEX:-0}}
+`))
+			Expect(string(script)).NotTo(ContainSubstring("s3cret"))
+			Expect(os.ReadFile(filepath.Join(stager.DepDir(), "appdynamics", "proxy-password"))).To(Equal([]byte("s3cret")))
+		})
+
+		It("uses the appdynamics.cfg of the app", func() {
+			os.Setenv("VCAP_SERVICES", `{"appdynamics": [{"name": "appd", "credentials": {`+credentials+`}}]}`)
+			Expect(os.WriteFile(filepath.Join(buildDir, "appdynamics.cfg"), []byte("[agent]\n"), 0644)).To(Succeed())
+			Expect(appdynamics.BeforeCompile(stager)).To(Succeed())
+
+			Expect(os.ReadFile(filepath.Join(stager.DepDir(), "profile.d", "appdynamics.sh"))).To(Equal([]byte(`# Autogenerated Appdynamics Script
+
+export APPD_CONFIG_FILE=${APPD_CONFIG_FILE:-"$HOME/appdynamics.cfg"}
+`)))
+			Expect(os.ReadFile(filepath.Join(buildDir, "Procfile"))).To(Equal([]byte("web: pyagent run -- python app.py\n")))
+		})
+
+		It("fails on a port that is not a number", func() {
+			os.Setenv("VCAP_SERVICES", `{"appdynamics": [{"name": "appd", "credentials": {"host-name": "controller.test.com", "port": "https"}}]}`)
+			Expect(appdynamics.BeforeCompile(stager)).To(MatchError(`port must be a port number, got "https"`))
+			Expect(supply.ExtraPackages()).To(BeEmpty())
+		})
+
+		It("fails on an ssl flag that is not a boolean", func() {
+			os.Setenv("VCAP_SERVICES", `{"appdynamics": [{"name": "appd", "credentials": {"host-name": "controller.test.com", "ssl-enabled": "maybe"}}]}`)
+			Expect(appdynamics.BeforeCompile(stager)).To(MatchError(`ssl-enabled must be true or false, got "maybe"`))
+		})
+	})
 })
@@ -0,0 +1,127 @@
+package hooks
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/python-buildpack/src/python/services"
+	"github.com/cloudfoundry/python-buildpack/src/python/supply"
+)
+
+// Services labelled, tagged, named or typed like this, including
+// user-provided ones, configure the Datadog tracer.
+var datadogServiceMatcher = services.Matcher{
+	Labels:      []string{"datadog"},
+	Tags:        []string{"datadog"},
+	NamePattern: regexp.MustCompile("datadog"),
+	Types:       []string{"datadog"},
+}
+
+// datadogCredentials maps binding credentials to the DD_* variables of the
+// tracer. The API key is left out, the tracer reports to an agent that holds
+// it.
+var datadogCredentials = map[string][]string{
+	"DD_SITE":            {"site"},
+	"DD_AGENT_HOST":      {"agent_host", "host"},
+	"DD_TRACE_AGENT_URL": {"trace_agent_url", "url"},
+	"DD_ENV":             {"env"},
+}
+
+type DatadogHook struct {
+	libbuildpack.DefaultHook
+	Log *libbuildpack.Logger
+}
+
+func (h DatadogHook) BeforeCompile(stager *libbuildpack.Stager) error {
+	enabled, set, err := datadogTraceEnabled()
+	if err != nil {
+		h.Log.Error("%v", err)
+		return err
+	} else if set && !enabled {
+		h.Log.Debug("DD_TRACE_ENABLED is false, skipping Datadog")
+		return nil
+	}
+
+	resolver, err := services.NewResolver()
+	if err != nil {
+		h.Log.Debug("Could not load service bindings, exiting: %v", err)
+		return nil
+	}
+
+	service, found, err := resolver.Find(datadogServiceMatcher)
+	if err != nil {
+		h.Log.Error("Could not select the Datadog service: %v", err)
+		return err
+	} else if !found && !enabled {
+		return nil
+	}
+
+	h.Log.BeginStep("Setting up Datadog")
+	if found {
+		h.Log.Info("Using Datadog service %s", service.DisplayName())
+	}
+
+	supply.AddExtraPackage(supply.ExtraPackage{Name: "ddtrace", Source: "Datadog"})
+
+	if err := stager.WriteProfileD("datadog.sh", generateProfileScript("Datadog", datadogEnvironment(service))); err != nil {
+		h.Log.Error("Could not create Datadog environment: %v", err)
+		return err
+	}
+
+	if err := wrapAgentProcesses(h.Log, stager, "ddtrace-run"); err != nil {
+		h.Log.Error("Could not rewrite Procfile with ddtrace-run: %v", err)
+		return err
+	}
+	return nil
+}
+
+// datadogEnvironment tags traces with the app, its space and its version,
+// unless the binding says otherwise.
+func datadogEnvironment(service services.Service) map[string]string {
+	env := map[string]string{
+		"DD_LOGS_INJECTION": "true",
+	}
+
+	application := vcapApplication()
+	if application.ApplicationName != "" {
+		env["DD_SERVICE"] = application.ApplicationName
+	}
+	if application.SpaceName != "" {
+		env["DD_ENV"] = application.SpaceName
+	}
+	if application.ApplicationVersion != "" {
+		env["DD_VERSION"] = application.ApplicationVersion
+	}
+
+	for name, keys := range datadogCredentials {
+		if value := service.Credential(keys...); value != "" {
+			env[name] = value
+		}
+	}
+	return env
+}
+
+// datadogTraceEnabled parses DD_TRACE_ENABLED, which enables the tracer
+// without a service or disables it despite one. set is false when it is
+// not given.
+func datadogTraceEnabled() (enabled bool, set bool, err error) {
+	value := os.Getenv("DD_TRACE_ENABLED")
+	if value == "" {
+		return false, false, nil
+	}
+	enabled, err = strconv.ParseBool(value)
+	if err != nil {
+		return false, false, fmt.Errorf("invalid DD_TRACE_ENABLED %q: use true or false", value)
+	}
+	return enabled, true, nil
+}
+
+func init() {
+	logger := libbuildpack.NewLogger(os.Stdout)
+	libbuildpack.AddHook(DatadogHook{
+		Log: logger,
+	})
+}
@@ -0,0 +1,125 @@
+package hooks_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/python-buildpack/src/python/hooks"
+	"github.com/cloudfoundry/python-buildpack/src/python/supply"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/libbuildpack/ansicleaner"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Datadog", func() {
+	var (
+		err      error
+		buildDir string
+		depsDir  string
+		stager   *libbuildpack.Stager
+		buffer   *bytes.Buffer
+		datadog  hooks.DatadogHook
+	)
+
+	BeforeEach(func() {
+		buildDir, err = os.MkdirTemp("", "python-buildpack.build.")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, buildDir)
+
+		depsDir, err = os.MkdirTemp("", "python-buildpack.deps.")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, depsDir)
+
+		buffer = new(bytes.Buffer)
+		logger := libbuildpack.NewLogger(ansicleaner.New(buffer))
+
+		args := []string{buildDir, "", depsDir, buildOrder}
+		stager = libbuildpack.NewStager(args, logger, &libbuildpack.Manifest{})
+		datadog = hooks.DatadogHook{Log: logger}
+
+		envs := []string{"VCAP_SERVICES", "VCAP_APPLICATION", "SERVICE_BINDING_ROOT", "BP_AGENT_PROCESS_TYPES"}
+		for _, env := range os.Environ() {
+			if strings.HasPrefix(env, "DD_") {
+				envs = append(envs, strings.SplitN(env, "=", 2)[0])
+			}
+		}
+		for _, env := range envs {
+			DeferCleanup(os.Setenv, env, os.Getenv(env))
+			Expect(os.Unsetenv(env)).To(Succeed())
+		}
+		DeferCleanup(os.Unsetenv, "DD_TRACE_ENABLED")
+		DeferCleanup(os.Unsetenv, "DD_AGENT_HOST")
+		supply.ClearExtraPackages()
+		DeferCleanup(supply.ClearExtraPackages)
+
+		os.Setenv("VCAP_APPLICATION", `{"application_name": "shop", "space_name": "production", "application_version": "1f2e3d"}`)
+		Expect(os.WriteFile(filepath.Join(buildDir, "Procfile"), []byte("web: gunicorn app:app\nworker: celery -A app worker\n"), 0644)).To(Succeed())
+	})
+
+	Context("Datadog is not configured", func() {
+		It("does nothing", func() {
+			Expect(datadog.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(BeEmpty())
+			Expect(filepath.Join(depsDir, buildOrder, "profile.d", "datadog.sh")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Context("a Datadog service is bound", func() {
+		BeforeEach(func() {
+			os.Setenv("VCAP_SERVICES", `{"user-provided": [{"name": "datadog", "credentials": {"api_key": "secret", "site": "datadoghq.eu"}}]}`)
+		})
+
+		It("installs ddtrace and tags traces with the app", func() {
+			Expect(datadog.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{{Name: "ddtrace", Source: "Datadog"}}))
+			Expect(os.ReadFile(filepath.Join(depsDir, buildOrder, "profile.d", "datadog.sh"))).To(Equal([]byte(`# Autogenerated Datadog Script
+
+export DD_ENV=${DD_ENV:-'production'}
+export DD_LOGS_INJECTION=${DD_LOGS_INJECTION:-'true'}
+export DD_SERVICE=${DD_SERVICE:-'shop'}
+export DD_SITE=${DD_SITE:-'datadoghq.eu'}
+export DD_VERSION=${DD_VERSION:-'1f2e3d'}
+`)))
+		})
+
+		It("wraps the selected process types with ddtrace-run", func() {
+			os.Setenv("BP_AGENT_PROCESS_TYPES", "worker")
+			Expect(datadog.BeforeCompile(stager)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(buildDir, "Procfile"))).To(Equal([]byte("web: gunicorn app:app\nworker: ddtrace-run celery -A app worker\n")))
+		})
+
+		It("does nothing when DD_TRACE_ENABLED is false", func() {
+			os.Setenv("DD_TRACE_ENABLED", "0")
+			Expect(datadog.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(BeEmpty())
+		})
+
+		It("fails on an invalid DD_TRACE_ENABLED", func() {
+			os.Setenv("DD_TRACE_ENABLED", "maybe")
+			Expect(datadog.BeforeCompile(stager)).To(MatchError(`invalid DD_TRACE_ENABLED "maybe": use true or false`))
+		})
+	})
+
+	Context("DD_* variables are set without a service", func() {
+		BeforeEach(func() {
+			os.Setenv("DD_AGENT_HOST", "datadog-agent.internal")
+		})
+
+		It("does nothing", func() {
+			Expect(datadog.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(BeEmpty())
+			Expect(os.ReadFile(filepath.Join(buildDir, "Procfile"))).To(HavePrefix("web: gunicorn app:app\n"))
+		})
+
+		It("sets up the tracer when DD_TRACE_ENABLED is true", func() {
+			os.Setenv("DD_TRACE_ENABLED", "true")
+			Expect(datadog.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{{Name: "ddtrace", Source: "Datadog"}}))
+			Expect(os.ReadFile(filepath.Join(buildDir, "Procfile"))).To(HavePrefix("web: ddtrace-run gunicorn app:app\n"))
+		})
+	})
+})
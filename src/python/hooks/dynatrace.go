@@ -1,10 +1,116 @@
 package hooks
 
 import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
 	"github.com/Dynatrace/libbuildpack-dynatrace"
 	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/python-buildpack/src/python/services"
+	"github.com/cloudfoundry/python-buildpack/src/python/supply"
 )
 
+// EnvDynatraceMode selects how a bound Dynatrace service is used. It takes
+// precedence over the "mode" credential of the service.
+const EnvDynatraceMode = "BP_DYNATRACE_MODE"
+
+const (
+	// DynatraceModeFullStack downloads the OneAgent into the droplet and
+	// injects it into every process.
+	DynatraceModeFullStack = "fullstack"
+	// DynatraceModeSDK only installs the Python OneAgent SDK, which reports
+	// to a OneAgent that is already running on the host.
+	DynatraceModeSDK = "sdk"
+)
+
+// Services with "dynatrace" in the label, or in the name of user-provided
+// ones, configure the OneAgent. The OneAgent installer ignores the case.
+var dynatraceServiceMatcher = services.Matcher{
+	NamePattern: regexp.MustCompile("(?i)dynatrace"),
+}
+
+type DynatraceHook struct {
+	libbuildpack.DefaultHook
+	Log *libbuildpack.Logger
+	// OneAgent installs the agent in full-stack mode.
+	OneAgent libbuildpack.Hook
+}
+
+func (h DynatraceHook) BeforeCompile(stager *libbuildpack.Stager) error {
+	mode, service, found, err := h.Mode()
+	if err != nil {
+		return err
+	} else if !found {
+		return nil
+	}
+
+	h.Log.BeginStep("Setting up Dynatrace")
+	h.Log.Info("Using Dynatrace service %s in %s mode", service.DisplayName(), mode)
+
+	switch mode {
+	case DynatraceModeSDK:
+		supply.AddExtraPackage(supply.ExtraPackage{
+			Name:    "oneagent-sdk",
+			Version: service.Credential("sdkversion", "sdk_version"),
+			Source:  "Dynatrace",
+		})
+		h.Log.Info("Installing the OneAgent SDK without process injection, call oneagent.initialize() in the app to enable it")
+	case DynatraceModeFullStack:
+		h.Log.Info("Installing the OneAgent with process injection")
+	}
+	return nil
+}
+
+// AfterCompile installs the OneAgent unless SDK mode was requested. The
+// OneAgent installer looks up the service on its own.
+func (h DynatraceHook) AfterCompile(stager *libbuildpack.Stager) error {
+	mode, _, found, err := h.Mode()
+	if err != nil {
+		return err
+	} else if found && mode == DynatraceModeSDK {
+		return nil
+	}
+	return h.OneAgent.AfterCompile(stager)
+}
+
+// Mode returns the mode the bound Dynatrace service is used in, if any.
+func (h DynatraceHook) Mode() (string, services.Service, bool, error) {
+	resolver, err := services.NewResolver()
+	if err != nil {
+		h.Log.Debug("Could not load service bindings, exiting: %v", err)
+		return "", services.Service{}, false, nil
+	}
+
+	service, found, err := resolver.Find(dynatraceServiceMatcher)
+	if err != nil {
+		h.Log.Error("Could not select the Dynatrace service: %v", err)
+		return "", services.Service{}, false, err
+	} else if !found {
+		return "", services.Service{}, false, nil
+	}
+
+	mode := os.Getenv(EnvDynatraceMode)
+	if mode == "" {
+		mode = service.Credential("mode")
+	}
+	switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+	case "":
+		return DynatraceModeFullStack, service, true, nil
+	case DynatraceModeFullStack, DynatraceModeSDK:
+		return mode, service, true, nil
+	}
+
+	err = fmt.Errorf("unknown Dynatrace mode %q, use %s or %s", mode, DynatraceModeFullStack, DynatraceModeSDK)
+	h.Log.Error("%v", err)
+	return "", services.Service{}, false, err
+}
+
 func init() {
-	libbuildpack.AddHook(dynatrace.NewHook("sdk", "process"))
+	logger := libbuildpack.NewLogger(os.Stdout)
+	libbuildpack.AddHook(DynatraceHook{
+		Log:      logger,
+		OneAgent: dynatrace.NewHook("sdk", "process"),
+	})
 }
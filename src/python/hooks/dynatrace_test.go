@@ -0,0 +1,147 @@
+package hooks_test
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/cloudfoundry/python-buildpack/src/python/hooks"
+	"github.com/cloudfoundry/python-buildpack/src/python/supply"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/libbuildpack/ansicleaner"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type fakeOneAgent struct {
+	libbuildpack.DefaultHook
+	installed *bool
+}
+
+func (f fakeOneAgent) AfterCompile(*libbuildpack.Stager) error {
+	*f.installed = true
+	return nil
+}
+
+var _ = Describe("Dynatrace", func() {
+	var (
+		err       error
+		buildDir  string
+		depsDir   string
+		stager    *libbuildpack.Stager
+		buffer    *bytes.Buffer
+		installed bool
+		dynatrace hooks.DynatraceHook
+	)
+
+	BeforeEach(func() {
+		buildDir, err = os.MkdirTemp("", "python-buildpack.build.")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, buildDir)
+
+		depsDir, err = os.MkdirTemp("", "python-buildpack.deps.")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, depsDir)
+
+		buffer = new(bytes.Buffer)
+		logger := libbuildpack.NewLogger(ansicleaner.New(buffer))
+
+		args := []string{buildDir, "", depsDir, buildOrder}
+		stager = libbuildpack.NewStager(args, logger, &libbuildpack.Manifest{})
+		installed = false
+		dynatrace = hooks.DynatraceHook{Log: logger, OneAgent: fakeOneAgent{installed: &installed}}
+
+		for _, env := range []string{"VCAP_SERVICES", "SERVICE_BINDING_ROOT", "BP_DYNATRACE_MODE"} {
+			DeferCleanup(os.Setenv, env, os.Getenv(env))
+			Expect(os.Unsetenv(env)).To(Succeed())
+		}
+		supply.ClearExtraPackages()
+		DeferCleanup(supply.ClearExtraPackages)
+	})
+
+	Context("no Dynatrace service is bound", func() {
+		It("leaves it to the OneAgent installer", func() {
+			Expect(dynatrace.BeforeCompile(stager)).To(Succeed())
+			Expect(dynatrace.AfterCompile(stager)).To(Succeed())
+			Expect(installed).To(BeTrue())
+			Expect(supply.ExtraPackages()).To(BeEmpty())
+			Expect(buffer.String()).NotTo(ContainSubstring("Setting up Dynatrace"))
+		})
+	})
+
+	Context("a Dynatrace service is bound", func() {
+		BeforeEach(func() {
+			os.Setenv("VCAP_SERVICES", `{"user-provided": [{"name": "dynatrace", "credentials": {"environmentid": "abc", "apitoken": "secret"}}]}`)
+		})
+
+		It("injects the OneAgent by default", func() {
+			Expect(dynatrace.BeforeCompile(stager)).To(Succeed())
+			Expect(dynatrace.AfterCompile(stager)).To(Succeed())
+			Expect(installed).To(BeTrue())
+			Expect(supply.ExtraPackages()).To(BeEmpty())
+			Expect(buffer.String()).To(ContainSubstring("Using Dynatrace service dynatrace in fullstack mode"))
+		})
+
+		It("only installs the SDK when BP_DYNATRACE_MODE is sdk", func() {
+			os.Setenv("BP_DYNATRACE_MODE", "SDK")
+			Expect(dynatrace.BeforeCompile(stager)).To(Succeed())
+			Expect(dynatrace.AfterCompile(stager)).To(Succeed())
+			Expect(installed).To(BeFalse())
+			Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{{Name: "oneagent-sdk", Source: "Dynatrace"}}))
+			Expect(buffer.String()).To(ContainSubstring("Using Dynatrace service dynatrace in sdk mode"))
+		})
+
+		It("fails on an unknown mode", func() {
+			os.Setenv("BP_DYNATRACE_MODE", "agentless")
+			Expect(dynatrace.BeforeCompile(stager)).To(MatchError(`unknown Dynatrace mode "agentless", use fullstack or sdk`))
+		})
+	})
+
+	Context("the service name is capitalized", func() {
+		BeforeEach(func() {
+			os.Setenv("VCAP_SERVICES", `{"user-provided": [{"name": "My-Dynatrace", "credentials": {"mode": "sdk"}}]}`)
+		})
+
+		It("finds the service like the OneAgent installer", func() {
+			Expect(dynatrace.BeforeCompile(stager)).To(Succeed())
+			Expect(dynatrace.AfterCompile(stager)).To(Succeed())
+			Expect(installed).To(BeFalse())
+			Expect(buffer.String()).To(ContainSubstring("Using Dynatrace service My-Dynatrace in sdk mode"))
+		})
+	})
+
+	Context("several Dynatrace services are bound", func() {
+		BeforeEach(func() {
+			os.Setenv("VCAP_SERVICES", `{"user-provided": [
+				{"name": "dynatrace-settings", "credentials": {"tag": "python"}},
+				{"name": "dynatrace", "credentials": {"environmentid": "abc", "apitoken": "secret"}}
+			]}`)
+		})
+
+		It("reports the ambiguous bindings", func() {
+			Expect(dynatrace.BeforeCompile(stager)).To(MatchError("2 service bindings match, bind only one of: dynatrace-settings, dynatrace"))
+			Expect(dynatrace.AfterCompile(stager)).To(HaveOccurred())
+			Expect(installed).To(BeFalse())
+			Expect(buffer.String()).NotTo(ContainSubstring("Setting up Dynatrace"))
+		})
+	})
+
+	Context("the service selects SDK mode", func() {
+		BeforeEach(func() {
+			os.Setenv("VCAP_SERVICES", `{"dynatrace": [{"name": "dynatrace-prod", "credentials": {"mode": "sdk", "sdkversion": "1.5.1"}}]}`)
+		})
+
+		It("pins the SDK version from the binding", func() {
+			Expect(dynatrace.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{{Name: "oneagent-sdk", Version: "1.5.1", Source: "Dynatrace"}}))
+		})
+
+		It("lets BP_DYNATRACE_MODE override the binding", func() {
+			os.Setenv("BP_DYNATRACE_MODE", "fullstack")
+			Expect(dynatrace.BeforeCompile(stager)).To(Succeed())
+			Expect(dynatrace.AfterCompile(stager)).To(Succeed())
+			Expect(installed).To(BeTrue())
+			Expect(supply.ExtraPackages()).To(BeEmpty())
+		})
+	})
+})
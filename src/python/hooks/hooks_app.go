@@ -1,30 +1,71 @@
 package hooks
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/cloudfoundry/libbuildpack"
 )
 
+const EnvHookTimeout = "BP_HOOK_TIMEOUT"
+
+// Hook scripts of the app in bin/, in the order they run
+const (
+	PreCompileHook      = "pre_compile"
+	PreDependenciesHook = "pre_dependencies"
+	PostSupplyHook      = "post_supply"
+	PostCompileHook     = "post_compile"
+	PreReleaseHook      = "pre_release"
+)
+
 type AppHook struct {
 	libbuildpack.DefaultHook
 }
 
+// AppHookRunner runs the hook scripts of the app at lifecycle points that
+// libbuildpack hooks do not cover: pre_dependencies once Python or conda is
+// installed and before the package indexes are configured, post_supply once
+// the dependencies are installed and pre_release after finalize.
+type AppHookRunner struct {
+	Stager *libbuildpack.Stager
+}
+
+func (r AppHookRunner) Run(scriptName string) error {
+	return runHook(scriptName, r.Stager)
+}
+
 func init() {
 	libbuildpack.AddHook(AppHook{})
 }
 
 func (h AppHook) BeforeCompile(compiler *libbuildpack.Stager) error {
-	return runHook("pre_compile", compiler)
+	return runHook(PreCompileHook, compiler)
 }
 
 func (h AppHook) AfterCompile(compiler *libbuildpack.Stager) error {
-	return runHook("post_compile", compiler)
+	return runHook(PostCompileHook, compiler)
 }
 
+// runHook runs bin/<scriptName> of the app from the build dir and streams its
+// output line by line. The script gets the staging layout in its environment:
+//
+//	BUILD_DIR  the app directory
+//	CACHE_DIR  the app cache, kept between stagings
+//	DEPS_DIR   the directory of all buildpack dependencies
+//	DEPS_IDX   the index of this buildpack in DEPS_DIR
+//	PYTHON     the interpreter of the app, once it is installed
+//
+// BP_HOOK_TIMEOUT limits the run time, e.g. "10m" or a number of seconds.
 func runHook(scriptName string, compiler *libbuildpack.Stager) error {
 	path := filepath.Join(compiler.BuildDir(), "bin", scriptName)
 	if exists, err := libbuildpack.FileExists(path); err != nil {
@@ -40,23 +81,98 @@ func runHook(scriptName string, compiler *libbuildpack.Stager) error {
 			return err
 		}
 
+		timeout, err := hookTimeout()
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
 		shebangRegex := regexp.MustCompile("^\\s*#!")
 		hasShebang := shebangRegex.Match(fileContents)
 
 		var cmd *exec.Cmd
 		if hasShebang {
-			cmd = exec.Command(path)
+			cmd = exec.CommandContext(ctx, path)
 		} else {
-			cmd = exec.Command("/bin/sh", path)
+			cmd = exec.CommandContext(ctx, "/bin/sh", path)
 		}
 
 		cmd.Dir = compiler.BuildDir()
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return err
+		cmd.Env = append(os.Environ(), hookEnv(compiler)...)
+
+		// Kill the whole process group on timeout, so that children of the
+		// script do not keep the output open
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+		cmd.WaitDelay = 5 * time.Second
+
+		output, writer := io.Pipe()
+		cmd.Stdout = writer
+		cmd.Stderr = writer
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			scanner := bufio.NewScanner(output)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+			for scanner.Scan() {
+				compiler.Logger().Info("%s", scanner.Text())
+			}
+			io.Copy(io.Discard, output)
+		}()
+
+		err = cmd.Run()
+		writer.Close()
+		<-done
+
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s hook timed out after %s", scriptName, timeout)
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("%s hook failed with exit code %d", scriptName, exitErr.ExitCode())
+		} else if err != nil {
+			return fmt.Errorf("could not run %s hook: %v", scriptName, err)
 		}
-		compiler.Logger().Info("%s", output)
 	}
 	return nil
 
 }
+
+func hookEnv(compiler *libbuildpack.Stager) []string {
+	env := []string{
+		"BUILD_DIR=" + compiler.BuildDir(),
+		"CACHE_DIR=" + compiler.CacheDir(),
+		"DEPS_DIR=" + compiler.DepsDir(),
+		"DEPS_IDX=" + compiler.DepsIdx(),
+	}
+
+	python := filepath.Join(compiler.DepDir(), "bin", "python")
+	if exists, err := libbuildpack.FileExists(python); err == nil && exists {
+		env = append(env, "PYTHON="+python)
+	}
+	return env
+}
+
+func hookTimeout() (time.Duration, error) {
+	value := os.Getenv(EnvHookTimeout)
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: use a duration such as 10m or a number of seconds", EnvHookTimeout, value)
+	}
+	return timeout, nil
+}
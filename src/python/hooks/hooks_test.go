@@ -110,4 +110,62 @@ var _ = Describe("Hooks", func() {
 			Expect(buffer.String()).NotTo(ContainSubstring("Running post_compile hook"))
 		})
 	})
+
+	Describe("AppHookRunner", func() {
+		It("runs the named script of the app", func() {
+			Expect(os.Mkdir(filepath.Join(buildDir, "bin"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(buildDir, "bin", "pre_release"), []byte("#!/bin/sh\necho releasing\n"), 0644)).To(Succeed())
+
+			Expect(hooks.AppHookRunner{Stager: stager}.Run(hooks.PreReleaseHook)).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("Running pre_release hook"))
+			Expect(buffer.String()).To(ContainSubstring("releasing"))
+		})
+
+		It("does nothing when the script does NOT exist", func() {
+			Expect(hooks.AppHookRunner{Stager: stager}.Run(hooks.PostSupplyHook)).To(Succeed())
+			Expect(buffer.String()).To(BeEmpty())
+		})
+	})
+
+	Describe("hook scripts", func() {
+		writeHook := func(contents string) {
+			Expect(os.MkdirAll(filepath.Join(buildDir, "bin"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(buildDir, "bin", "pre_compile"), []byte(contents), 0644)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			DeferCleanup(os.Setenv, "BP_HOOK_TIMEOUT", os.Getenv("BP_HOOK_TIMEOUT"))
+			os.Unsetenv("BP_HOOK_TIMEOUT")
+		})
+
+		It("logs every line of stdout and stderr", func() {
+			writeHook("#!/bin/sh\necho first\necho second >&2\n")
+			Expect(hook.BeforeCompile(stager)).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("       first\n       second\n"))
+		})
+
+		It("passes the staging layout", func() {
+			writeHook("#!/bin/sh\necho \"build=$BUILD_DIR deps=$DEPS_DIR idx=$DEPS_IDX\"\n")
+			Expect(hook.BeforeCompile(stager)).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("build=" + buildDir + " deps=/tmp/not-exist idx=9"))
+		})
+
+		It("reports the exit code", func() {
+			writeHook("#!/bin/sh\necho broken\nexit 3\n")
+			Expect(hook.BeforeCompile(stager)).To(MatchError("pre_compile hook failed with exit code 3"))
+			Expect(buffer.String()).To(ContainSubstring("broken"))
+		})
+
+		It("stops the script after BP_HOOK_TIMEOUT", func() {
+			os.Setenv("BP_HOOK_TIMEOUT", "100ms")
+			writeHook("#!/bin/sh\nsleep 10 &\nsleep 10\n")
+			Expect(hook.BeforeCompile(stager)).To(MatchError("pre_compile hook timed out after 100ms"))
+		})
+
+		It("rejects an invalid BP_HOOK_TIMEOUT", func() {
+			os.Setenv("BP_HOOK_TIMEOUT", "soon")
+			writeHook("#!/bin/sh\n")
+			Expect(hook.BeforeCompile(stager)).To(MatchError(ContainSubstring(`invalid BP_HOOK_TIMEOUT "soon"`)))
+		})
+	})
 })
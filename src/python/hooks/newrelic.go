@@ -0,0 +1,103 @@
+package hooks
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/python-buildpack/src/python/services"
+	"github.com/cloudfoundry/python-buildpack/src/python/supply"
+)
+
+// Services labelled, tagged, named or typed like this, including
+// user-provided ones, configure the New Relic agent.
+var newRelicServiceMatcher = services.Matcher{
+	Labels:      []string{"newrelic"},
+	Tags:        []string{"newrelic"},
+	NamePattern: regexp.MustCompile("new(-)?relic"),
+	Types:       []string{"newrelic"},
+}
+
+type NewRelicHook struct {
+	libbuildpack.DefaultHook
+	Log *libbuildpack.Logger
+}
+
+func (h NewRelicHook) BeforeCompile(stager *libbuildpack.Stager) error {
+	resolver, err := services.NewResolver()
+	if err != nil {
+		h.Log.Debug("Could not load service bindings, exiting: %v", err)
+		return nil
+	}
+
+	service, found, err := resolver.Find(newRelicServiceMatcher)
+	if err != nil {
+		h.Log.Error("Could not select the New Relic service: %v", err)
+		return err
+	} else if !found {
+		return nil
+	}
+
+	h.Log.BeginStep("Setting up New Relic")
+
+	env, err := h.Environment(stager, service)
+	if err != nil {
+		return err
+	}
+	if env["NEW_RELIC_LICENSE_KEY"] == "" {
+		h.Log.Warning("New Relic service %s has no license key, not installing the agent", service.DisplayName())
+		return nil
+	}
+
+	supply.AddExtraPackage(supply.ExtraPackage{Name: "newrelic", Source: "New Relic"})
+
+	if err := stager.WriteProfileD("newrelic.sh", generateProfileScript("New Relic", env)); err != nil {
+		h.Log.Error("Could not create New Relic environment: %v", err)
+		return err
+	}
+
+	if err := wrapAgentProcesses(h.Log, stager, "newrelic-admin run-program"); err != nil {
+		h.Log.Error("Could not rewrite Procfile with newrelic-admin: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Environment configures the agent through NEW_RELIC_* variables. A
+// newrelic.ini of the app is used as the base configuration.
+func (h NewRelicHook) Environment(stager *libbuildpack.Stager, service services.Service) (map[string]string, error) {
+	env := map[string]string{
+		"NEW_RELIC_LOG": "stdout",
+	}
+
+	if application := vcapApplication(); application.ApplicationName != "" {
+		env["NEW_RELIC_APP_NAME"] = application.ApplicationName
+	}
+
+	credentials := map[string][]string{
+		"NEW_RELIC_LICENSE_KEY": {"licenseKey", "license_key", "licence_key"},
+		"NEW_RELIC_APP_NAME":    {"appName", "app_name"},
+		"NEW_RELIC_HOST":        {"host", "collector_host"},
+	}
+	for name, keys := range credentials {
+		if value := service.Credential(keys...); value != "" {
+			env[name] = value
+		}
+	}
+
+	if exists, err := libbuildpack.FileExists(filepath.Join(stager.BuildDir(), "newrelic.ini")); err != nil {
+		return nil, err
+	} else if exists {
+		h.Log.Info("Using newrelic.ini of the app")
+		env["NEW_RELIC_CONFIG_FILE"] = runtimePath("$HOME", "newrelic.ini")
+	}
+	return env, nil
+}
+
+func init() {
+	logger := libbuildpack.NewLogger(os.Stdout)
+	libbuildpack.AddHook(NewRelicHook{
+		Log: logger,
+	})
+}
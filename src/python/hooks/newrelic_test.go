@@ -0,0 +1,108 @@
+package hooks_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/python-buildpack/src/python/hooks"
+	"github.com/cloudfoundry/python-buildpack/src/python/supply"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/libbuildpack/ansicleaner"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NewRelic", func() {
+	var (
+		err      error
+		buildDir string
+		depsDir  string
+		stager   *libbuildpack.Stager
+		buffer   *bytes.Buffer
+		newrelic hooks.NewRelicHook
+	)
+
+	BeforeEach(func() {
+		buildDir, err = os.MkdirTemp("", "python-buildpack.build.")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, buildDir)
+
+		depsDir, err = os.MkdirTemp("", "python-buildpack.deps.")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, depsDir)
+
+		buffer = new(bytes.Buffer)
+		logger := libbuildpack.NewLogger(ansicleaner.New(buffer))
+
+		args := []string{buildDir, "", depsDir, buildOrder}
+		stager = libbuildpack.NewStager(args, logger, &libbuildpack.Manifest{})
+		newrelic = hooks.NewRelicHook{Log: logger}
+
+		for _, env := range []string{"VCAP_SERVICES", "VCAP_APPLICATION", "SERVICE_BINDING_ROOT", "BP_AGENT_PROCESS_TYPES"} {
+			DeferCleanup(os.Setenv, env, os.Getenv(env))
+			Expect(os.Unsetenv(env)).To(Succeed())
+		}
+		supply.ClearExtraPackages()
+		DeferCleanup(supply.ClearExtraPackages)
+
+		Expect(os.WriteFile(filepath.Join(buildDir, "Procfile"), []byte("web: gunicorn app:app\n"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(buildDir, "requirements.txt"), []byte("flask\n"), 0644)).To(Succeed())
+	})
+
+	Context("no New Relic service is bound", func() {
+		It("does nothing", func() {
+			Expect(newrelic.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(BeEmpty())
+			Expect(os.ReadFile(filepath.Join(buildDir, "Procfile"))).To(Equal([]byte("web: gunicorn app:app\n")))
+		})
+	})
+
+	Context("a New Relic service is bound", func() {
+		BeforeEach(func() {
+			os.Setenv("VCAP_SERVICES", `{"newrelic": [{"name": "apm", "credentials": {"licenseKey": "secret-key", "host": "collector.eu.nr-data.net"}}]}`)
+			os.Setenv("VCAP_APPLICATION", `{"application_name": "shop"}`)
+		})
+
+		It("adds the agent without touching requirements.txt", func() {
+			Expect(newrelic.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{{Name: "newrelic", Source: "New Relic"}}))
+			Expect(os.ReadFile(filepath.Join(buildDir, "requirements.txt"))).To(Equal([]byte("flask\n")))
+		})
+
+		It("configures the agent from the binding", func() {
+			Expect(newrelic.BeforeCompile(stager)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(depsDir, buildOrder, "profile.d", "newrelic.sh"))).To(Equal([]byte(`# Autogenerated New Relic Script
+
+export NEW_RELIC_APP_NAME=${NEW_RELIC_APP_NAME:-'shop'}
+export NEW_RELIC_HOST=${NEW_RELIC_HOST:-'collector.eu.nr-data.net'}
+export NEW_RELIC_LICENSE_KEY=${NEW_RELIC_LICENSE_KEY:-'secret-key'}
+export NEW_RELIC_LOG=${NEW_RELIC_LOG:-'stdout'}
+`)))
+		})
+
+		It("uses the newrelic.ini of the app", func() {
+			Expect(os.WriteFile(filepath.Join(buildDir, "newrelic.ini"), []byte("[newrelic]\n"), 0644)).To(Succeed())
+			Expect(newrelic.BeforeCompile(stager)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(depsDir, buildOrder, "profile.d", "newrelic.sh"))).To(ContainSubstring("export NEW_RELIC_CONFIG_FILE=${NEW_RELIC_CONFIG_FILE:-\"$HOME/newrelic.ini\"}"))
+		})
+
+		It("wraps the web process with newrelic-admin", func() {
+			Expect(newrelic.BeforeCompile(stager)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(buildDir, "Procfile"))).To(Equal([]byte("web: newrelic-admin run-program gunicorn app:app\n")))
+		})
+	})
+
+	Context("the New Relic service has no license key", func() {
+		BeforeEach(func() {
+			os.Setenv("VCAP_SERVICES", `{"user-provided": [{"name": "my-newrelic", "credentials": {}}]}`)
+		})
+
+		It("does not install the agent", func() {
+			Expect(newrelic.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(BeEmpty())
+			Expect(buffer.String()).To(ContainSubstring("New Relic service my-newrelic has no license key"))
+		})
+	})
+})
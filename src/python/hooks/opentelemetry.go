@@ -0,0 +1,166 @@
+package hooks
+
+import (
+	"os"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/python-buildpack/src/python/requirements"
+	"github.com/cloudfoundry/python-buildpack/src/python/services"
+	"github.com/cloudfoundry/python-buildpack/src/python/supply"
+)
+
+const EnvOtelEnabled = "BP_OTEL_ENABLED"
+
+// Services labelled, tagged, named or typed like this are OpenTelemetry
+// collectors.
+var otelServiceMatcher = services.Matcher{
+	Labels: []string{"opentelemetry", "otel"},
+	Tags:   []string{"opentelemetry", "otel", "otel-collector"},
+	Names:  []string{"opentelemetry", "otel", "otel-collector"},
+	Types:  []string{"opentelemetry", "otel"},
+}
+
+var otelPackages = []string{"opentelemetry-distro", "opentelemetry-exporter-otlp"}
+
+// otelInstrumentations lists the instrumentation that traces a library, by
+// the names the library is required under.
+var otelInstrumentations = []struct {
+	names           []string
+	instrumentation string
+}{
+	{[]string{"celery", "Celery"}, "opentelemetry-instrumentation-celery"},
+	{[]string{"django", "Django"}, "opentelemetry-instrumentation-django"},
+	{[]string{"fastapi", "FastAPI"}, "opentelemetry-instrumentation-fastapi"},
+	{[]string{"flask", "Flask"}, "opentelemetry-instrumentation-flask"},
+	{[]string{"httpx"}, "opentelemetry-instrumentation-httpx"},
+	{[]string{"psycopg2", "psycopg2-binary"}, "opentelemetry-instrumentation-psycopg2"},
+	{[]string{"pymongo"}, "opentelemetry-instrumentation-pymongo"},
+	{[]string{"redis"}, "opentelemetry-instrumentation-redis"},
+	{[]string{"requests"}, "opentelemetry-instrumentation-requests"},
+	{[]string{"sqlalchemy", "SQLAlchemy"}, "opentelemetry-instrumentation-sqlalchemy"},
+	{[]string{"urllib3"}, "opentelemetry-instrumentation-urllib3"},
+}
+
+// otelCredentials maps binding credentials to the OTEL_* variables of the
+// SDK. Credentials named OTEL_* are passed on as they are.
+var otelCredentials = map[string][]string{
+	"OTEL_EXPORTER_OTLP_ENDPOINT": {"endpoint", "otlp_endpoint", "url", "uri"},
+	"OTEL_EXPORTER_OTLP_PROTOCOL": {"protocol"},
+	"OTEL_EXPORTER_OTLP_HEADERS":  {"headers"},
+}
+
+type OpenTelemetryHook struct {
+	libbuildpack.DefaultHook
+	Log *libbuildpack.Logger
+}
+
+func (h OpenTelemetryHook) BeforeCompile(stager *libbuildpack.Stager) error {
+	enabled, explicit := otelEnabled()
+	if explicit && !enabled {
+		h.Log.Debug("%s is disabled, skipping OpenTelemetry", EnvOtelEnabled)
+		return nil
+	}
+
+	resolver, err := services.NewResolver()
+	if err != nil {
+		h.Log.Debug("Could not load service bindings, exiting: %v", err)
+		return nil
+	}
+
+	service, found, err := resolver.Find(otelServiceMatcher)
+	if err != nil {
+		h.Log.Error("Could not select the OpenTelemetry collector service: %v", err)
+		return err
+	} else if !found && !enabled {
+		return nil
+	}
+
+	h.Log.BeginStep("Setting up OpenTelemetry")
+
+	packages, err := h.Packages(stager.BuildDir())
+	if err != nil {
+		h.Log.Error("Could not detect OpenTelemetry instrumentations: %v", err)
+		return err
+	}
+	for _, pkg := range packages {
+		supply.AddExtraPackage(supply.ExtraPackage{Name: pkg, Source: "OpenTelemetry"})
+	}
+
+	env := otelEnvironment(service)
+	if found {
+		h.Log.Info("Exporting to collector service %s", service.DisplayName())
+	}
+	if err := stager.WriteProfileD("opentelemetry.sh", generateProfileScript("OpenTelemetry", env)); err != nil {
+		h.Log.Error("Could not create OpenTelemetry environment: %v", err)
+		return err
+	}
+
+	if err := wrapAgentProcesses(h.Log, stager, "opentelemetry-instrument"); err != nil {
+		h.Log.Error("Could not rewrite Procfile with opentelemetry-instrument: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Packages returns the distro, the OTLP exporter and the instrumentations for
+// the libraries in the requirements of the app.
+func (h OpenTelemetryHook) Packages(buildDir string) ([]string, error) {
+	packages := append([]string{}, otelPackages...)
+	for _, library := range otelInstrumentations {
+		found, err := requirements.Reqs{Log: h.Log}.FindAnyPackage(buildDir, library.names...)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			packages = append(packages, library.instrumentation)
+		}
+	}
+	return packages, nil
+}
+
+func otelEnvironment(service services.Service) map[string]string {
+	env := map[string]string{
+		"OTEL_TRACES_EXPORTER":  "otlp",
+		"OTEL_METRICS_EXPORTER": "otlp",
+		"OTEL_LOGS_EXPORTER":    "otlp",
+	}
+
+	if application := vcapApplication(); application.ApplicationName != "" {
+		env["OTEL_SERVICE_NAME"] = application.ApplicationName
+	}
+
+	for name, keys := range otelCredentials {
+		if value := service.Credential(keys...); value != "" {
+			env[name] = value
+		}
+	}
+	for key := range service.Credentials {
+		if name := strings.ToUpper(key); strings.HasPrefix(name, "OTEL_") {
+			if value := service.Credential(key); value != "" {
+				env[name] = value
+			}
+		}
+	}
+	return env
+}
+
+// otelEnabled reports the value of BP_OTEL_ENABLED and whether it is set.
+func otelEnabled() (enabled bool, explicit bool) {
+	value, ok := os.LookupEnv(EnvOtelEnabled)
+	if !ok || strings.TrimSpace(value) == "" {
+		return false, false
+	}
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes", "on":
+		return true, true
+	}
+	return false, true
+}
+
+func init() {
+	logger := libbuildpack.NewLogger(os.Stdout)
+	libbuildpack.AddHook(OpenTelemetryHook{
+		Log: logger,
+	})
+}
@@ -0,0 +1,131 @@
+package hooks_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/python-buildpack/src/python/hooks"
+	"github.com/cloudfoundry/python-buildpack/src/python/supply"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/libbuildpack/ansicleaner"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OpenTelemetry", func() {
+	var (
+		err      error
+		buildDir string
+		depsDir  string
+		stager   *libbuildpack.Stager
+		buffer   *bytes.Buffer
+		otel     hooks.OpenTelemetryHook
+	)
+
+	BeforeEach(func() {
+		buildDir, err = os.MkdirTemp("", "python-buildpack.build.")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, buildDir)
+
+		depsDir, err = os.MkdirTemp("", "python-buildpack.deps.")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, depsDir)
+
+		buffer = new(bytes.Buffer)
+		logger := libbuildpack.NewLogger(ansicleaner.New(buffer))
+
+		args := []string{buildDir, "", depsDir, buildOrder}
+		stager = libbuildpack.NewStager(args, logger, &libbuildpack.Manifest{})
+		otel = hooks.OpenTelemetryHook{Log: logger}
+		supply.ClearExtraPackages()
+		DeferCleanup(supply.ClearExtraPackages)
+
+		for _, env := range []string{"VCAP_SERVICES", "VCAP_APPLICATION", "SERVICE_BINDING_ROOT", "BP_OTEL_ENABLED", "BP_AGENT_PROCESS_TYPES"} {
+			DeferCleanup(os.Setenv, env, os.Getenv(env))
+			Expect(os.Unsetenv(env)).To(Succeed())
+		}
+
+		Expect(os.WriteFile(filepath.Join(buildDir, "Procfile"), []byte("web: gunicorn app:app\nworker: celery -A app worker\n"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(buildDir, "requirements.txt"), []byte("Flask==3.0.0\nrequests\n"), 0644)).To(Succeed())
+	})
+
+	Context("no collector is bound", func() {
+		It("does nothing", func() {
+			Expect(otel.BeforeCompile(stager)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(buildDir, "Procfile"))).To(Equal([]byte("web: gunicorn app:app\nworker: celery -A app worker\n")))
+			Expect(filepath.Join(depsDir, buildOrder, "profile.d", "opentelemetry.sh")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Context("a collector service is bound", func() {
+		BeforeEach(func() {
+			os.Setenv("VCAP_SERVICES", `{"user-provided": [{"name": "collector", "tags": ["otel"], "credentials": {"endpoint": "https://otel.example.com:4318", "protocol": "http/protobuf", "OTEL_RESOURCE_ATTRIBUTES": "team=payments"}}]}`)
+			os.Setenv("VCAP_APPLICATION", `{"application_name": "shop"}`)
+		})
+
+		It("installs the distro and the instrumentations of the app", func() {
+			Expect(otel.BeforeCompile(stager)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(buildDir, "requirements.txt"))).To(Equal([]byte("Flask==3.0.0\nrequests\n")))
+			Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{
+				{Name: "opentelemetry-distro", Source: "OpenTelemetry"},
+				{Name: "opentelemetry-exporter-otlp", Source: "OpenTelemetry"},
+				{Name: "opentelemetry-instrumentation-flask", Source: "OpenTelemetry"},
+				{Name: "opentelemetry-instrumentation-requests", Source: "OpenTelemetry"},
+			}))
+		})
+
+		It("configures the exporter from the binding", func() {
+			Expect(otel.BeforeCompile(stager)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(depsDir, buildOrder, "profile.d", "opentelemetry.sh"))).To(Equal([]byte(`# Autogenerated OpenTelemetry Script
+
+export OTEL_EXPORTER_OTLP_ENDPOINT=${OTEL_EXPORTER_OTLP_ENDPOINT:-'https://otel.example.com:4318'}
+export OTEL_EXPORTER_OTLP_PROTOCOL=${OTEL_EXPORTER_OTLP_PROTOCOL:-'http/protobuf'}
+export OTEL_LOGS_EXPORTER=${OTEL_LOGS_EXPORTER:-'otlp'}
+export OTEL_METRICS_EXPORTER=${OTEL_METRICS_EXPORTER:-'otlp'}
+export OTEL_RESOURCE_ATTRIBUTES=${OTEL_RESOURCE_ATTRIBUTES:-'team=payments'}
+export OTEL_SERVICE_NAME=${OTEL_SERVICE_NAME:-'shop'}
+export OTEL_TRACES_EXPORTER=${OTEL_TRACES_EXPORTER:-'otlp'}
+`)))
+		})
+
+		It("wraps the web process", func() {
+			Expect(otel.BeforeCompile(stager)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(buildDir, "Procfile"))).To(Equal([]byte("web: opentelemetry-instrument gunicorn app:app\nworker: celery -A app worker\n")))
+		})
+
+		It("wraps the process types in BP_AGENT_PROCESS_TYPES", func() {
+			os.Setenv("BP_AGENT_PROCESS_TYPES", "*")
+			Expect(otel.BeforeCompile(stager)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(buildDir, "Procfile"))).To(Equal([]byte("web: opentelemetry-instrument gunicorn app:app\nworker: opentelemetry-instrument celery -A app worker\n")))
+		})
+
+		It("does nothing when BP_OTEL_ENABLED is false", func() {
+			os.Setenv("BP_OTEL_ENABLED", "false")
+			Expect(otel.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(BeEmpty())
+		})
+	})
+
+	Context("BP_OTEL_ENABLED is set without a collector service", func() {
+		BeforeEach(func() {
+			os.Setenv("BP_OTEL_ENABLED", "true")
+			Expect(os.Remove(filepath.Join(buildDir, "requirements.txt"))).To(Succeed())
+		})
+
+		It("instruments the app with the default exporter settings", func() {
+			Expect(otel.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{
+				{Name: "opentelemetry-distro", Source: "OpenTelemetry"},
+				{Name: "opentelemetry-exporter-otlp", Source: "OpenTelemetry"},
+			}))
+			Expect(filepath.Join(buildDir, "requirements.txt")).NotTo(BeAnExistingFile())
+
+			script, err := os.ReadFile(filepath.Join(depsDir, buildOrder, "profile.d", "opentelemetry.sh"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(script)).To(ContainSubstring("export OTEL_TRACES_EXPORTER="))
+			Expect(string(script)).NotTo(ContainSubstring("OTEL_EXPORTER_OTLP_ENDPOINT"))
+		})
+	})
+})
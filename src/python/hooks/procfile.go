@@ -0,0 +1,62 @@
+package hooks
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/python-buildpack/src/python/procfile"
+)
+
+// wrapProcfile prefixes the agent process types of a Procfile with launcher.
+func wrapProcfile(contents, launcher string) (string, error) {
+	p, err := procfile.Parse(contents)
+	if err != nil {
+		return "", err
+	}
+	p.Wrap(launcher, procfile.AgentProcessTypes()...)
+	return p.String(), nil
+}
+
+func rewriteProcfile(procFilePath, launcher string) error {
+	contents, err := os.ReadFile(procFilePath)
+	if err != nil {
+		return fmt.Errorf("Error reading file %s: %v", procFilePath, err)
+	}
+	newContents, err := wrapProcfile(string(contents), launcher)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(procFilePath, []byte(newContents), 0666); err != nil {
+		return fmt.Errorf("Error writing file %s: %v", procFilePath, err)
+	}
+	return nil
+}
+
+// wrapAgentProcesses starts the agent process types of the app's Procfile
+// with launcher, e.g. "newrelic-admin run-program".
+func wrapAgentProcesses(log *libbuildpack.Logger, stager *libbuildpack.Stager, launcher string) error {
+	file := filepath.Join(stager.BuildDir(), "Procfile")
+	if exists, err := libbuildpack.FileExists(file); err != nil {
+		return err
+	} else if !exists {
+		log.Info("Cannot find Procfile, start the app with %s yourself", launcher)
+		return nil
+	}
+
+	log.BeginStep("Rewriting Procfile to start with %s", launcher)
+	p, err := procfile.Load(file)
+	if err != nil {
+		return err
+	}
+	wrapped := p.Wrap(launcher, procfile.AgentProcessTypes()...)
+	if len(wrapped) == 0 {
+		log.Warning("None of the process types %s is in the Procfile, no process is instrumented", strings.Join(procfile.AgentProcessTypes(), ", "))
+		return nil
+	}
+	log.Info("Instrumenting %s", strings.Join(wrapped, ", "))
+	return p.Save(file)
+}
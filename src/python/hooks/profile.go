@@ -0,0 +1,65 @@
+package hooks
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// generateProfileScript exports env from a profile.d script. Values set by
+// the user at runtime take precedence. Runtime paths, e.g. "$HOME/app.cfg",
+// are expanded when the script runs.
+func generateProfileScript(integration string, env map[string]string) string {
+	var keys []string
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	scriptContents := fmt.Sprintf("# Autogenerated %s Script\n", integration)
+	for _, key := range keys {
+		scriptContents += fmt.Sprintf("\nexport %s=${%s:-%s}", key, key, shellQuote(env[key]))
+	}
+	return scriptContents + "\n"
+}
+
+// Paths in the container are only known at runtime, so they are given
+// relative to one of these variables.
+var runtimePathPrefixes = []string{"$HOME/", "$DEPS_DIR/"}
+
+var doubleQuoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`", "$", `\$`)
+
+// shellQuote quotes value as a single shell word. Runtime paths are double
+// quoted, so that their variable is expanded when the app starts.
+func shellQuote(value string) string {
+	for _, prefix := range runtimePathPrefixes {
+		if strings.HasPrefix(value, prefix) {
+			return `"` + prefix + doubleQuoteEscaper.Replace(strings.TrimPrefix(value, prefix)) + `"`
+		}
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// runtimePath returns the path of the file of the droplet at runtime, e.g.
+// "$DEPS_DIR/0/sealights/token".
+func runtimePath(root string, elem ...string) string {
+	return root + "/" + path.Join(elem...)
+}
+
+// writeSecretFile stores a secret readable only by the app in the deps dir of
+// the droplet, so that it is not exposed in the environment or the start
+// command. It returns the path of the file at runtime.
+func writeSecretFile(stager *libbuildpack.Stager, dir, name, secret string) (string, error) {
+	if err := os.MkdirAll(filepath.Join(stager.DepDir(), dir), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(stager.DepDir(), dir, name), []byte(secret), 0600); err != nil {
+		return "", err
+	}
+	return runtimePath("$DEPS_DIR", stager.DepsIdx(), dir, name), nil
+}
@@ -1,48 +1,62 @@
 package hooks
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/cloudfoundry/libbuildpack"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/python-buildpack/src/python/services"
+	"github.com/cloudfoundry/python-buildpack/src/python/supply"
 )
 
+// Services labelled or named like this, including user-provided ones,
+// configure the Sealights agent.
+var sealightsServiceMatcher = services.Matcher{
+	NamePattern: regexp.MustCompile("sealights"),
+	Types:       []string{"sealights"},
+}
+
 type SealightsPlan struct {
-	Credentials SealightsCredentials `json:"credentials"`
-	Name        string               `json:"name,omitempty"`
+	Credentials SealightsCredentials
+	Name        string
 }
 type SealightsCredentials struct {
-	Token     string `json:"token",omitempty`
-	TokenFile string `json:"tokenFile",omitempty`
-	BsId      string `json:"bsid",omitempty`
-	BsIdFile  string `json:"bsidFile",omitempty`
-	Proxy     string `json:"proxy",omitempty`
-	LabId     string `json:"labid",omitempty`
-	Version   string `json:"version",omitempty`
+	Token         string
+	TokenFile     string
+	BsId          string
+	BsIdFile      string
+	Proxy         string
+	LabId         string
+	Version       string
+	AppName       string
+	BranchName    string
+	BuildName     string
+	TestStage     string
+	CoverageFlags string
 }
 type SealightsConfig struct {
-	Token     string
-	TokenFile string
-	BsId      string
-	BsIdFile  string
-	Proxy     string
-	LabId     string
-	Version   string
+	Token         string
+	TokenFile     string
+	BsId          string
+	BsIdFile      string
+	Proxy         string
+	LabId         string
+	Version       string
+	AppName       string
+	BranchName    string
+	BuildName     string
+	TestStage     string
+	CoverageFlags string
 }
 
+var shellSafeRegex = regexp.MustCompile(`^[A-Za-z0-9_./:@%+=,-]+$`)
+
 func NewSealightsConfig() *SealightsConfig {
-	return &SealightsConfig{
-		Token:     "",
-		TokenFile: "",
-		BsId:      "",
-		BsIdFile:  "",
-		Proxy:     "",
-		LabId:     "",
-		Version:   "",
-	}
+	return &SealightsConfig{}
 }
 
 func (sc *SealightsConfig) getEnv(key, fallback string) string {
@@ -59,31 +73,88 @@ func (sc *SealightsConfig) parseSealightsPlan(plan SealightsPlan) *SealightsConf
 	sc.Proxy = sc.getEnv("SL_PROXY", plan.Credentials.Proxy)
 	sc.LabId = sc.getEnv("SL_LAB_ID", plan.Credentials.LabId)
 	sc.Version = sc.getEnv("SL_VERSION", plan.Credentials.Version)
+	sc.AppName = sc.getEnv("SL_APP_NAME", plan.Credentials.AppName)
+	sc.BranchName = sc.getEnv("SL_BRANCH_NAME", plan.Credentials.BranchName)
+	sc.BuildName = sc.getEnv("SL_BUILD_NAME", plan.Credentials.BuildName)
+	sc.TestStage = sc.getEnv("SL_TEST_STAGE", plan.Credentials.TestStage)
+	sc.CoverageFlags = sc.getEnv("SL_COVERAGE_FLAGS", plan.Credentials.CoverageFlags)
 	return sc
 }
 
-func (sc *SealightsConfig) GetStartFlags() string {
-	var flags []string
+// Validate reports settings the agent cannot start with.
+func (sc *SealightsConfig) Validate() error {
+	if sc.Token == "" && sc.TokenFile == "" {
+		return errors.New("a token or tokenFile is required")
+	}
+	build := map[string]string{"appName": sc.AppName, "branchName": sc.BranchName, "buildName": sc.BuildName}
+	var missing []string
+	for _, key := range []string{"appName", "branchName", "buildName"} {
+		if build[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 && len(missing) < len(build) {
+		return fmt.Errorf("appName, branchName and buildName must be set together, missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// WriteTokenFile moves the token into a file of the droplet, so that it does
+// not show up in the start command of the app.
+func (sc *SealightsConfig) WriteTokenFile(stager *libbuildpack.Stager) error {
+	if sc.Token == "" {
+		return nil
+	}
+	tokenFile, err := writeSecretFile(stager, "sealights", "token", sc.Token)
+	if err != nil {
+		return err
+	}
+	sc.Token = ""
+	sc.TokenFile = tokenFile
+	return nil
+}
+
+// GetStartFlags returns the options of "sl-python run". The token is only
+// ever passed by file, so WriteTokenFile must have been called before.
+func (sc *SealightsConfig) GetStartFlags() (string, error) {
 	if sc.Token != "" {
-		flags = append(flags, fmt.Sprintf("--token %s", sc.Token))
-	} else if sc.TokenFile != "" {
-		flags = append(flags, fmt.Sprintf("--tokenfile %s", sc.TokenFile))
+		return "", errors.New("the token must be written to a file before the start command is built")
 	}
-	if sc.BsId != "" {
-		flags = append(flags, fmt.Sprintf("--buildsessionid %s", sc.BsId))
-	} else if sc.BsIdFile != "" {
-		flags = append(flags, fmt.Sprintf("--buildsessionidfile %s", sc.BsIdFile))
+
+	var flags []string
+	addFlag := func(name, value string) {
+		if value != "" {
+			flags = append(flags, fmt.Sprintf("--%s %s", name, shellArg(value)))
+		}
 	}
-	if sc.Proxy != "" {
-		flags = append(flags, fmt.Sprintf("--proxy %s", sc.Proxy))
+
+	addFlag("tokenfile", sc.TokenFile)
+	if sc.BsId != "" {
+		addFlag("buildsessionid", sc.BsId)
+	} else {
+		addFlag("buildsessionidfile", sc.BsIdFile)
 	}
-	if sc.LabId != "" {
-		flags = append(flags, fmt.Sprintf("--labid %s", sc.LabId))
+	addFlag("proxy", sc.Proxy)
+	addFlag("labid", sc.LabId)
+	addFlag("appname", sc.AppName)
+	addFlag("branchname", sc.BranchName)
+	addFlag("buildname", sc.BuildName)
+	addFlag("teststage", sc.TestStage)
+	for _, flag := range strings.Fields(sc.CoverageFlags) {
+		flags = append(flags, shellArg(flag))
 	}
+
 	if len(flags) == 0 {
-		return ""
+		return "", nil
 	}
-	return " " + strings.Join(flags, " ")
+	return " " + strings.Join(flags, " "), nil
+}
+
+func shellArg(value string) string {
+	if shellSafeRegex.MatchString(value) {
+		return value
+	}
+	return shellQuote(value)
 }
 
 type SealightsHook struct {
@@ -92,29 +163,40 @@ type SealightsHook struct {
 }
 
 func (sh SealightsHook) BeforeCompile(stager *libbuildpack.Stager) error {
-	vcapServices := os.Getenv("VCAP_SERVICES")
-	services := make(map[string][]SealightsPlan)
-
-	err := json.Unmarshal([]byte(vcapServices), &services)
+	resolver, err := services.NewResolver()
 	if err != nil {
-		sh.Log.Debug("Could not unmarshall VCAP_SERVICES JSON exiting: %v", err)
+		sh.Log.Debug("Could not load service bindings, exiting: %v", err)
 		return nil
 	}
 
-	sealightsServiceName, sealightsPlan := getSealightsServiceName(services)
-
-	if sealightsServiceName == "" {
+	service, found, err := resolver.Find(sealightsServiceMatcher)
+	if err != nil {
+		sh.Log.Error("Could not select the Sealights service: %v", err)
+		return err
+	} else if !found {
 		sh.Log.Debug("No Sealights service found, exiting")
 		return nil
 	}
+	sealightsPlan := newSealightsPlan(service)
+
 	sh.Log.BeginStep("Setting up Sealights hook")
 	sealightsConfig := NewSealightsConfig().parseSealightsPlan(sealightsPlan)
-	if err := sh.RewriteRequirementsFile(stager, sealightsConfig.Version); err != nil {
-		sh.Log.Error("Could not write requirements file with Sealights package: %v", err)
+	if err := sealightsConfig.Validate(); err != nil {
+		sh.Log.Error("Invalid Sealights configuration of service %s: %v", service.DisplayName(), err)
+		return fmt.Errorf("Invalid Sealights configuration: %v", err)
+	}
+	if err := sealightsConfig.WriteTokenFile(stager); err != nil {
+		sh.Log.Error("Failed to write the Sealights token file: %v", err)
 		return err
 	}
+	startFlags, err := sealightsConfig.GetStartFlags()
+	if err != nil {
+		sh.Log.Error("Invalid Sealights configuration of service %s: %v", service.DisplayName(), err)
+		return err
+	}
+	supply.AddExtraPackage(supply.ExtraPackage{Name: "sealights-python-agent", Version: sealightsConfig.Version, Source: "Sealights"})
 
-	if err := sh.RewriteProcFileWithSealights(stager, sealightsConfig.GetStartFlags()); err != nil {
+	if err := sh.RewriteProcFileWithSealights(stager, startFlags); err != nil {
 		sh.Log.Error("Failed to rewrite Procfile with Sealights: %s", err.Error())
 		return fmt.Errorf("Failed to rewrite Procfile with Sealights: %s", err.Error())
 	}
@@ -145,79 +227,33 @@ func (sh SealightsHook) RewriteProcFileWithSealights(stager *libbuildpack.Stager
 	}
 	return nil
 }
-func getSealightsServiceName(services map[string][]SealightsPlan) (string, SealightsPlan) {
-	for serviceName, servicePlans := range services {
-		if strings.Contains(serviceName, "sealights") {
-			return serviceName, servicePlans[0]
-		}
+func newSealightsPlan(service services.Service) SealightsPlan {
+	return SealightsPlan{
+		Name: service.Name,
+		Credentials: SealightsCredentials{
+			Token:         service.Credential("token"),
+			TokenFile:     service.Credential("tokenFile"),
+			BsId:          service.Credential("bsid"),
+			BsIdFile:      service.Credential("bsidFile"),
+			Proxy:         service.Credential("proxy"),
+			LabId:         service.Credential("labid"),
+			Version:       service.Credential("version"),
+			AppName:       service.Credential("appName", "appname"),
+			BranchName:    service.Credential("branchName", "branchname"),
+			BuildName:     service.Credential("buildName", "buildname"),
+			TestStage:     service.Credential("testStage", "teststage"),
+			CoverageFlags: service.Credential("coverageFlags"),
+		},
 	}
-
-	// checking if there is a user-provided service with name sealights
-	userProvidedServices, keyExists := services["user-provided"]
-	if !keyExists {
-		return "", SealightsPlan{}
-	}
-
-	for _, plan := range userProvidedServices {
-		if strings.Contains(plan.Name, "sealights") {
-			return plan.Name, plan
-		}
-	}
-	return "", SealightsPlan{}
 }
 
 func (sh SealightsHook) RewriteProcFile(procFilePath string, cfgFlags string) error {
-	startCommand, err := os.ReadFile(procFilePath)
-	if err != nil {
-		return fmt.Errorf("Error reading file %s: %v", procFilePath, err)
-	}
-	newCommand, err := sh.GenerateStartUpCommand(string(startCommand), cfgFlags)
-	if err != nil {
-		return err
-	}
-
-	if err := os.WriteFile(procFilePath, []byte(newCommand), 0666); err != nil {
-		return fmt.Errorf("Error writing file %s: %v", procFilePath, err)
-	}
-	return nil
+	return rewriteProcfile(procFilePath, fmt.Sprintf("sl-python run%s --", cfgFlags))
 }
 
 func (sh SealightsHook) GenerateStartUpCommand(startCommand string, cfgFlags string) (string, error) {
-	webCommands := strings.SplitN(startCommand, ":", 2)
-	if len(webCommands) != 2 {
-		return "", errors.New("improper format found in Procfile")
-	}
-	return fmt.Sprintf("web: sl-python run%s -- %s", cfgFlags, webCommands[1]), nil
+	return wrapProcfile(startCommand, fmt.Sprintf("sl-python run%s --", cfgFlags))
 }
-func (sh SealightsHook) RewriteRequirementsFile(stager *libbuildpack.Stager, version string) error {
-	sealightsPackage := "sealights-python-agent"
-	if version != "" {
-		sealightsPackage = fmt.Sprintf("sealights-python-agent==%s", version)
-	}
-	reqFile := filepath.Join(stager.BuildDir(), "requirements.txt")
-	writeFlag := os.O_APPEND | os.O_WRONLY
-	packageName := "\n" + sealightsPackage
-
-	if exists, err := libbuildpack.FileExists(reqFile); err != nil {
-		return err
-	} else if !exists {
-		sh.Log.Info("Requirements file not found creating one with sealights packages")
-		writeFlag = os.O_CREATE | os.O_WRONLY
-		packageName = sealightsPackage
-	}
-	f, err := os.OpenFile(reqFile, writeFlag, 0666)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		_ = f.Close()
-	}()
-	if _, err = f.WriteString(packageName); err != nil {
-		return err
-	}
-	return nil
-}
-
 func init() {
 	logger := libbuildpack.NewLogger(os.Stdout)
 	libbuildpack.AddHook(&SealightsHook{
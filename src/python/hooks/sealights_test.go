@@ -5,6 +5,7 @@ import (
 	"github.com/cloudfoundry/libbuildpack"
 	"github.com/cloudfoundry/libbuildpack/ansicleaner"
 	"github.com/cloudfoundry/python-buildpack/src/python/hooks"
+	"github.com/cloudfoundry/python-buildpack/src/python/supply"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"os"
@@ -34,6 +35,8 @@ var _ = Describe("Sealights", func() {
 
 		args := []string{buildDir, "", depsDir, buildOrder}
 		stager = libbuildpack.NewStager(args, logger, &libbuildpack.Manifest{})
+		supply.ClearExtraPackages()
+		DeferCleanup(supply.ClearExtraPackages)
 		sealights = hooks.SealightsHook{
 			Log: logger,
 		}
@@ -43,8 +46,10 @@ var _ = Describe("Sealights", func() {
 		It("Returns the command when it is provided in the correct format and empty config", func() {
 			slConfig := hooks.NewSealightsConfig()
 			startCommand := "web: python flask.py"
-			ModifiedCommand, err := sealights.GenerateStartUpCommand(startCommand, slConfig.GetStartFlags())
-			Expect(ModifiedCommand).To(Equal("web: sl-python run --  python flask.py"))
+			flags, err := slConfig.GetStartFlags()
+			Expect(err).NotTo(HaveOccurred())
+			ModifiedCommand, err := sealights.GenerateStartUpCommand(startCommand, flags)
+			Expect(ModifiedCommand).To(Equal("web: sl-python run -- python flask.py"))
 			Expect(err).NotTo(HaveOccurred())
 		})
 
@@ -57,11 +62,19 @@ var _ = Describe("Sealights", func() {
 				Proxy:     "some-proxy",
 				LabId:     "some-labid",
 			}
+			Expect(slConfig.WriteTokenFile(stager)).To(Succeed())
 			startCommand := "web: python flask.py"
-			ModifiedCommand, err := sealights.GenerateStartUpCommand(startCommand, slConfig.GetStartFlags())
-			Expect(ModifiedCommand).To(Equal("web: sl-python run --token some-token --buildsessionid some-bsid --proxy some-proxy --labid some-labid --  python flask.py"))
+			flags, err := slConfig.GetStartFlags()
+			Expect(err).NotTo(HaveOccurred())
+			ModifiedCommand, err := sealights.GenerateStartUpCommand(startCommand, flags)
+			Expect(ModifiedCommand).To(Equal("web: sl-python run --tokenfile \"$DEPS_DIR/9/sealights/token\" --buildsessionid some-bsid --proxy some-proxy --labid some-labid -- python flask.py"))
 			Expect(err).NotTo(HaveOccurred())
 		})
+		It("Refuses to build the command before the token is written to a file", func() {
+			slConfig := &hooks.SealightsConfig{Token: "some-token"}
+			_, err := slConfig.GetStartFlags()
+			Expect(err).To(MatchError("the token must be written to a file before the start command is built"))
+		})
 		It("Returns the command when it is provided in the correct format with sl config 2", func() {
 			slConfig := &hooks.SealightsConfig{
 				Token:     "",
@@ -72,14 +85,33 @@ var _ = Describe("Sealights", func() {
 				LabId:     "some-labid",
 			}
 			startCommand := "web: python flask.py"
-			ModifiedCommand, err := sealights.GenerateStartUpCommand(startCommand, slConfig.GetStartFlags())
-			Expect(ModifiedCommand).To(Equal("web: sl-python run --tokenfile some-token-file --buildsessionidfile some-bsid-file --proxy some-proxy --labid some-labid --  python flask.py"))
+			flags, err := slConfig.GetStartFlags()
+			Expect(err).NotTo(HaveOccurred())
+			ModifiedCommand, err := sealights.GenerateStartUpCommand(startCommand, flags)
+			Expect(ModifiedCommand).To(Equal("web: sl-python run --tokenfile some-token-file --buildsessionidfile some-bsid-file --proxy some-proxy --labid some-labid -- python flask.py"))
 			Expect(err).NotTo(HaveOccurred())
 		})
+		It("Quotes the build options for the shell", func() {
+			slConfig := &hooks.SealightsConfig{
+				TokenFile:     "/home/vcap/deps/9/sealights/token",
+				AppName:       "shop",
+				BranchName:    "feature/checkout",
+				BuildName:     "build 42",
+				TestStage:     "Functional Tests",
+				CoverageFlags: "--cov-report /tmp/cov.xml",
+			}
+			flags, err := slConfig.GetStartFlags()
+			Expect(err).NotTo(HaveOccurred())
+			ModifiedCommand, err := sealights.GenerateStartUpCommand("web: python flask.py", flags)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ModifiedCommand).To(Equal("web: sl-python run --tokenfile /home/vcap/deps/9/sealights/token --appname shop --branchname feature/checkout --buildname 'build 42' --teststage 'Functional Tests' --cov-report /tmp/cov.xml -- python flask.py"))
+		})
 		It("Returns an error when provided the wrong format", func() {
 			slConfig := hooks.NewSealightsConfig()
 			startCommand := "python flask.py"
-			_, err := sealights.GenerateStartUpCommand(startCommand, slConfig.GetStartFlags())
+			flags, err := slConfig.GetStartFlags()
+			Expect(err).NotTo(HaveOccurred())
+			_, err = sealights.GenerateStartUpCommand(startCommand, flags)
 			Expect(err).To(MatchError("improper format found in Procfile"))
 		})
 
@@ -101,15 +133,19 @@ var _ = Describe("Sealights", func() {
 		It("rewrites the procfile with sl-python", func() {
 			Expect(os.WriteFile(filepath.Join(tempProcDir, "Procfile"), []byte("web: python app.py"), 0666)).To(Succeed())
 			Expect(err).NotTo(HaveOccurred())
-			err = sealights.RewriteProcFile(filepath.Join(tempProcDir, "Procfile"), slConfig.GetStartFlags())
+			flags, err := slConfig.GetStartFlags()
+			Expect(err).NotTo(HaveOccurred())
+			err = sealights.RewriteProcFile(filepath.Join(tempProcDir, "Procfile"), flags)
 			Expect(err).NotTo(HaveOccurred())
 			startCommand, err := os.ReadFile(filepath.Join(tempProcDir, "Procfile"))
 			Expect(err).NotTo(HaveOccurred())
-			Expect(string(startCommand)).To(Equal("web: sl-python run --  python app.py"))
+			Expect(string(startCommand)).To(Equal("web: sl-python run -- python app.py"))
 		})
 
 		It("Errors when Procfile doesn't exist", func() {
-			err := sealights.RewriteProcFile("/doesnt/exist", slConfig.GetStartFlags())
+			flags, err := slConfig.GetStartFlags()
+			Expect(err).NotTo(HaveOccurred())
+			err = sealights.RewriteProcFile("/doesnt/exist", flags)
 			Expect(err).To(MatchError("Error reading file /doesnt/exist: open /doesnt/exist: no such file or directory"))
 		})
 
@@ -117,43 +153,10 @@ var _ = Describe("Sealights", func() {
 			Expect(os.WriteFile(filepath.Join(tempProcDir, "WrongFormatProcFile"), []byte("python app.py"), 0666)).To(Succeed())
 			Expect(err).NotTo(HaveOccurred())
 
-			err = sealights.RewriteProcFile(filepath.Join(tempProcDir, "WrongFormatProcFile"), slConfig.GetStartFlags())
-			Expect(err).To(MatchError("improper format found in Procfile"))
-		})
-	})
-	Context("RewriteRequirementsFile when requirements.txt is not packaged", func() {
-		It("creates requirements.txt", func() {
-			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).ToNot(BeTrue())
-			err := sealights.RewriteRequirementsFile(stager, "")
+			flags, err := slConfig.GetStartFlags()
 			Expect(err).NotTo(HaveOccurred())
-			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeTrue())
-			packagesList, err := os.ReadFile(filepath.Join(buildDir, "requirements.txt"))
-			Expect(err).NotTo(HaveOccurred())
-			Expect(string(packagesList)).To(Equal("sealights-python-agent"))
-		})
-	})
-
-	Context("RewriteRequirementsFile when requirements.txt is packaged", func() {
-		BeforeEach(func() {
-			requirementsFilepath := filepath.Join(buildDir, "requirements.txt")
-			Expect(libbuildpack.FileExists(requirementsFilepath)).ToNot(BeTrue())
-			Expect(os.WriteFile(requirementsFilepath, []byte("Flask"), 0644)).To(Succeed())
-			DeferCleanup(os.Remove, filepath.Join(buildDir, "requirements.txt"))
-		})
-
-		It("Rewrites requirements.txt", func() {
-			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeTrue())
-			err := sealights.RewriteRequirementsFile(stager, "")
-			Expect(err).NotTo(HaveOccurred())
-			packages, err := os.ReadFile(filepath.Join(buildDir, "requirements.txt"))
-			Expect(string(packages)).To(Equal("Flask\nsealights-python-agent"))
-		})
-		It("Rewrites requirements.txt with sealights agent version", func() {
-			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeTrue())
-			err := sealights.RewriteRequirementsFile(stager, "1.1.1")
-			Expect(err).NotTo(HaveOccurred())
-			packages, err := os.ReadFile(filepath.Join(buildDir, "requirements.txt"))
-			Expect(string(packages)).To(Equal("Flask\nsealights-python-agent==1.1.1"))
+			err = sealights.RewriteProcFile(filepath.Join(tempProcDir, "WrongFormatProcFile"), flags)
+			Expect(err).To(MatchError("improper format found in Procfile"))
 		})
 	})
 	Context("VCAP_SERVICES is not present", func() {
@@ -205,28 +208,32 @@ var _ = Describe("Sealights", func() {
 			err := sealights.BeforeCompile(stager)
 			Expect(err).NotTo(HaveOccurred())
 
-			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeTrue())
-			packages, err := os.ReadFile(filepath.Join(buildDir, "requirements.txt"))
-			Expect(err).NotTo(HaveOccurred())
-			Expect(string(packages)).To(Equal("sealights-python-agent"))
+			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeFalse())
+			Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{{Name: "sealights-python-agent", Source: "Sealights"}}))
 
 			procCommand, err := os.ReadFile(filepath.Join(buildDir, "Procfile"))
 			Expect(err).NotTo(HaveOccurred())
-			Expect(string(procCommand)).To(Equal("web: sl-python run --tokenfile token.txt --  python app.py"))
+			Expect(string(procCommand)).To(Equal("web: sl-python run --tokenfile token.txt -- python app.py"))
 		})
-		It("BeforeCompile modify the existing Procfile by override by env", func() {
+		It("BeforeCompile writes a token set in the env to a file", func() {
 			os.Setenv("SL_TOKEN", "token")
 			err := sealights.BeforeCompile(stager)
 			Expect(err).NotTo(HaveOccurred())
 
-			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeTrue())
-			packages, err := os.ReadFile(filepath.Join(buildDir, "requirements.txt"))
-			Expect(err).NotTo(HaveOccurred())
-			Expect(string(packages)).To(Equal("sealights-python-agent"))
+			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeFalse())
+			Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{{Name: "sealights-python-agent", Source: "Sealights"}}))
+			Expect(os.ReadFile(filepath.Join(depsDir, buildOrder, "sealights", "token"))).To(Equal([]byte("token")))
 
 			procCommand, err := os.ReadFile(filepath.Join(buildDir, "Procfile"))
 			Expect(err).NotTo(HaveOccurred())
-			Expect(string(procCommand)).To(Equal("web: sl-python run --token token --  python app.py"))
+			Expect(string(procCommand)).To(Equal("web: sl-python run --tokenfile \"$DEPS_DIR/9/sealights/token\" -- python app.py"))
+			Expect(buffer.String()).NotTo(ContainSubstring("--token token"))
+		})
+		It("BeforeCompile pins the agent version", func() {
+			DeferCleanup(os.Unsetenv, "SL_VERSION")
+			os.Setenv("SL_VERSION", "1.1.1")
+			Expect(sealights.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{{Name: "sealights-python-agent", Version: "1.1.1", Source: "Sealights"}}))
 		})
 
 	})
@@ -241,14 +248,12 @@ var _ = Describe("Sealights", func() {
 			err := sealights.BeforeCompile(stager)
 			Expect(err).NotTo(HaveOccurred())
 
-			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeTrue())
-			packages, err := os.ReadFile(filepath.Join(buildDir, "requirements.txt"))
-			Expect(err).NotTo(HaveOccurred())
-			Expect(string(packages)).To(Equal("sealights-python-agent"))
+			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeFalse())
+			Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{{Name: "sealights-python-agent", Source: "Sealights"}}))
 
 			procCommand, err := os.ReadFile(filepath.Join(buildDir, "Procfile"))
 			Expect(err).NotTo(HaveOccurred())
-			Expect(string(procCommand)).To(Equal("web: sl-python run --tokenfile token.txt --  python app.py"))
+			Expect(string(procCommand)).To(Equal("web: sl-python run --tokenfile token.txt -- python app.py"))
 		})
 	})
 	Context("VCAP_SERVICES has user-provided sealights ", func() {
@@ -262,14 +267,70 @@ var _ = Describe("Sealights", func() {
 			err := sealights.BeforeCompile(stager)
 			Expect(err).NotTo(HaveOccurred())
 
-			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeTrue())
-			packages, err := os.ReadFile(filepath.Join(buildDir, "requirements.txt"))
+			Expect(libbuildpack.FileExists(filepath.Join(buildDir, "requirements.txt"))).To(BeFalse())
+			Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{{Name: "sealights-python-agent", Source: "Sealights"}}))
+
+			procCommand, err := os.ReadFile(filepath.Join(buildDir, "Procfile"))
 			Expect(err).NotTo(HaveOccurred())
-			Expect(string(packages)).To(Equal("sealights-python-agent"))
+			Expect(string(procCommand)).To(Equal("web: sl-python run --tokenfile sltoken.txt -- python app.py"))
+		})
+	})
+	Context("SERVICE_BINDING_ROOT has a sealights binding", func() {
+		BeforeEach(func() {
+			root, err := os.MkdirTemp("", "bindings")
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(os.RemoveAll, root)
+			Expect(os.Mkdir(filepath.Join(root, "agent"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, "agent", "type"), []byte("sealights\n"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, "agent", "tokenFile"), []byte("/bindings/token\n"), 0644)).To(Succeed())
+			DeferCleanup(os.Setenv, "SERVICE_BINDING_ROOT", os.Getenv("SERVICE_BINDING_ROOT"))
+			os.Setenv("SERVICE_BINDING_ROOT", root)
+			Expect(os.WriteFile(filepath.Join(buildDir, "Procfile"), []byte("web: python app.py"), 0644)).To(Succeed())
+		})
+		It("BeforeCompile modify the existing Procfile", func() {
+			Expect(sealights.BeforeCompile(stager)).To(Succeed())
 
 			procCommand, err := os.ReadFile(filepath.Join(buildDir, "Procfile"))
 			Expect(err).NotTo(HaveOccurred())
-			Expect(string(procCommand)).To(Equal("web: sl-python run --tokenfile sltoken.txt --  python app.py"))
+			Expect(string(procCommand)).To(Equal("web: sl-python run --tokenfile /bindings/token -- python app.py"))
+		})
+	})
+	Context("VCAP_SERVICES has several sealights services", func() {
+		BeforeEach(func() {
+			os.Setenv("VCAP_SERVICES", `{"sealights":[{"name":"sl-one","credentials":{"token":"a"}}],"user-provided":[{"name":"sealights-two","credentials":{"token":"b"}}]}`)
+			DeferCleanup(os.Unsetenv, "VCAP_SERVICES")
+			Expect(os.WriteFile(filepath.Join(buildDir, "Procfile"), []byte("web: python app.py"), 0644)).To(Succeed())
+		})
+		It("BeforeCompile reports the ambiguous bindings", func() {
+			err := sealights.BeforeCompile(stager)
+			Expect(err).To(MatchError("2 service bindings match, bind only one of: sl-one, sealights-two"))
+			Expect(os.ReadFile(filepath.Join(buildDir, "Procfile"))).To(Equal([]byte("web: python app.py")))
+		})
+	})
+	Context("VCAP_SERVICES has sealights with build options", func() {
+		BeforeEach(func() {
+			for _, env := range []string{"SL_APP_NAME", "SL_BRANCH_NAME", "SL_BUILD_NAME", "SL_TEST_STAGE"} {
+				DeferCleanup(os.Setenv, env, os.Getenv(env))
+				Expect(os.Unsetenv(env)).To(Succeed())
+			}
+			DeferCleanup(os.Unsetenv, "VCAP_SERVICES")
+			Expect(os.WriteFile(filepath.Join(buildDir, "Procfile"), []byte("web: python app.py"), 0644)).To(Succeed())
+		})
+		It("BeforeCompile passes them to the agent", func() {
+			os.Setenv("VCAP_SERVICES", `{"sealights":[{"name":"sl","credentials":{"token":"secret","appName":"shop","branchName":"main","buildName":"42"}}]}`)
+			os.Setenv("SL_TEST_STAGE", "Unit Tests")
+			Expect(sealights.BeforeCompile(stager)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(buildDir, "Procfile"))).To(Equal([]byte("web: sl-python run --tokenfile \"$DEPS_DIR/9/sealights/token\" --appname shop --branchname main --buildname 42 --teststage 'Unit Tests' -- python app.py")))
+		})
+		It("BeforeCompile fails without a token", func() {
+			os.Setenv("VCAP_SERVICES", `{"sealights":[{"name":"sl","credentials":{"bsid":"abc"}}]}`)
+			Expect(sealights.BeforeCompile(stager)).To(MatchError("Invalid Sealights configuration: a token or tokenFile is required"))
+			Expect(supply.ExtraPackages()).To(BeEmpty())
+			Expect(os.ReadFile(filepath.Join(buildDir, "Procfile"))).To(Equal([]byte("web: python app.py")))
+		})
+		It("BeforeCompile fails on incomplete build options", func() {
+			os.Setenv("VCAP_SERVICES", `{"sealights":[{"name":"sl","credentials":{"token":"secret","appName":"shop"}}]}`)
+			Expect(sealights.BeforeCompile(stager)).To(MatchError("Invalid Sealights configuration: appName, branchName and buildName must be set together, missing branchName, buildName"))
 		})
 	})
 	Context("VCAP_SERVICES has sealights and bad procfile", func() {
@@ -0,0 +1,134 @@
+package hooks
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/python-buildpack/src/python/services"
+	"github.com/cloudfoundry/python-buildpack/src/python/supply"
+)
+
+// Services labelled, tagged, named or typed like this, including
+// user-provided ones, provide a Sentry DSN.
+var sentryServiceMatcher = services.Matcher{
+	Labels:      []string{"sentry"},
+	Tags:        []string{"sentry", "error-tracking"},
+	NamePattern: regexp.MustCompile("sentry"),
+	Types:       []string{"sentry"},
+}
+
+var gitRevisionRegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+type SentryHook struct {
+	libbuildpack.DefaultHook
+	Log *libbuildpack.Logger
+}
+
+func (h SentryHook) BeforeCompile(stager *libbuildpack.Stager) error {
+	resolver, err := services.NewResolver()
+	if err != nil {
+		h.Log.Debug("Could not load service bindings, exiting: %v", err)
+		return nil
+	}
+
+	service, found, err := resolver.Find(sentryServiceMatcher)
+	if err != nil {
+		h.Log.Error("Could not select the Sentry service: %v", err)
+		return err
+	} else if !found {
+		return nil
+	}
+
+	h.Log.BeginStep("Setting up Sentry")
+
+	dsn := service.Credential("dsn", "sentry_dsn", "SENTRY_DSN")
+	if dsn == "" {
+		h.Log.Warning("Sentry service %s has no dsn credential, not configuring Sentry", service.DisplayName())
+		return nil
+	}
+
+	supply.AddExtraPackage(supply.ExtraPackage{Name: "sentry-sdk", Source: "Sentry"})
+
+	env := map[string]string{"SENTRY_DSN": dsn}
+	application := vcapApplication()
+	if environment := service.Credential("environment"); environment != "" {
+		env["SENTRY_ENVIRONMENT"] = environment
+	} else if application.SpaceName != "" {
+		env["SENTRY_ENVIRONMENT"] = application.SpaceName
+	}
+
+	release, err := gitRevision(stager.BuildDir())
+	if err != nil {
+		h.Log.Debug("Could not read the git revision of the app: %v", err)
+	}
+	if release == "" {
+		release = application.ApplicationVersion
+	}
+	if release != "" {
+		env["SENTRY_RELEASE"] = release
+	}
+
+	if err := stager.WriteProfileD("sentry.sh", generateProfileScript("Sentry", env)); err != nil {
+		h.Log.Error("Could not create Sentry environment: %v", err)
+		return err
+	}
+	h.Log.Info("Reporting errors to Sentry, call sentry_sdk.init() in the app to enable it")
+	return nil
+}
+
+// gitRevision returns the commit checked out in the .git directory of the
+// app, or "" if the app was pushed without one.
+func gitRevision(buildDir string) (string, error) {
+	gitDir := filepath.Join(buildDir, ".git")
+	head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	ref, isRef := strings.CutPrefix(strings.TrimSpace(string(head)), "ref: ")
+	if !isRef {
+		return validRevision(ref), nil
+	}
+
+	if revision, err := os.ReadFile(filepath.Join(gitDir, filepath.FromSlash(ref))); err == nil {
+		return validRevision(strings.TrimSpace(string(revision))), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	packedRefs, err := os.Open(filepath.Join(gitDir, "packed-refs"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer packedRefs.Close()
+
+	scanner := bufio.NewScanner(packedRefs)
+	for scanner.Scan() {
+		if revision, name, found := strings.Cut(scanner.Text(), " "); found && name == ref {
+			return validRevision(revision), nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+func validRevision(revision string) string {
+	if gitRevisionRegex.MatchString(revision) {
+		return revision
+	}
+	return ""
+}
+
+func init() {
+	logger := libbuildpack.NewLogger(os.Stdout)
+	libbuildpack.AddHook(SentryHook{
+		Log: logger,
+	})
+}
@@ -0,0 +1,114 @@
+package hooks_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/python-buildpack/src/python/hooks"
+	"github.com/cloudfoundry/python-buildpack/src/python/supply"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/libbuildpack/ansicleaner"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sentry", func() {
+	const revision = "0123456789abcdef0123456789abcdef01234567"
+
+	var (
+		err      error
+		buildDir string
+		depsDir  string
+		stager   *libbuildpack.Stager
+		buffer   *bytes.Buffer
+		sentry   hooks.SentryHook
+	)
+
+	BeforeEach(func() {
+		buildDir, err = os.MkdirTemp("", "python-buildpack.build.")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, buildDir)
+
+		depsDir, err = os.MkdirTemp("", "python-buildpack.deps.")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, depsDir)
+
+		buffer = new(bytes.Buffer)
+		logger := libbuildpack.NewLogger(ansicleaner.New(buffer))
+
+		args := []string{buildDir, "", depsDir, buildOrder}
+		stager = libbuildpack.NewStager(args, logger, &libbuildpack.Manifest{})
+		sentry = hooks.SentryHook{Log: logger}
+
+		for _, env := range []string{"VCAP_SERVICES", "VCAP_APPLICATION", "SERVICE_BINDING_ROOT"} {
+			DeferCleanup(os.Setenv, env, os.Getenv(env))
+			Expect(os.Unsetenv(env)).To(Succeed())
+		}
+		supply.ClearExtraPackages()
+		DeferCleanup(supply.ClearExtraPackages)
+
+		os.Setenv("VCAP_APPLICATION", `{"application_name": "shop", "space_name": "staging", "application_version": "1f2e3d"}`)
+	})
+
+	script := func() string {
+		contents, err := os.ReadFile(filepath.Join(depsDir, buildOrder, "profile.d", "sentry.sh"))
+		Expect(err).NotTo(HaveOccurred())
+		return string(contents)
+	}
+
+	Context("no Sentry service is bound", func() {
+		It("does nothing", func() {
+			Expect(sentry.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(BeEmpty())
+		})
+	})
+
+	Context("a Sentry service is bound", func() {
+		BeforeEach(func() {
+			os.Setenv("VCAP_SERVICES", `{"user-provided": [{"name": "errors", "tags": ["sentry"], "credentials": {"dsn": "https://key@o1.ingest.sentry.io/2"}}]}`)
+		})
+
+		It("installs sentry-sdk and exports the DSN", func() {
+			Expect(sentry.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(Equal([]supply.ExtraPackage{{Name: "sentry-sdk", Source: "Sentry"}}))
+			Expect(script()).To(Equal(`# Autogenerated Sentry Script
+
+export SENTRY_DSN=${SENTRY_DSN:-'https://key@o1.ingest.sentry.io/2'}
+export SENTRY_ENVIRONMENT=${SENTRY_ENVIRONMENT:-'staging'}
+export SENTRY_RELEASE=${SENTRY_RELEASE:-'1f2e3d'}
+`))
+		})
+
+		It("uses the checked out commit as release", func() {
+			Expect(os.MkdirAll(filepath.Join(buildDir, ".git", "refs", "heads"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(buildDir, ".git", "HEAD"), []byte("ref: refs/heads/main\n"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(buildDir, ".git", "refs", "heads", "main"), []byte(revision+"\n"), 0644)).To(Succeed())
+
+			Expect(sentry.BeforeCompile(stager)).To(Succeed())
+			Expect(script()).To(ContainSubstring("export SENTRY_RELEASE=${SENTRY_RELEASE:-'" + revision + "'}"))
+		})
+
+		It("finds the commit in packed refs", func() {
+			Expect(os.MkdirAll(filepath.Join(buildDir, ".git"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(buildDir, ".git", "HEAD"), []byte("ref: refs/heads/main\n"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(buildDir, ".git", "packed-refs"), []byte("# pack-refs with: peeled fully-peeled sorted\n"+revision+" refs/heads/main\n"), 0644)).To(Succeed())
+
+			Expect(sentry.BeforeCompile(stager)).To(Succeed())
+			Expect(script()).To(ContainSubstring("export SENTRY_RELEASE=${SENTRY_RELEASE:-'" + revision + "'}"))
+		})
+	})
+
+	Context("the Sentry service has no DSN", func() {
+		BeforeEach(func() {
+			os.Setenv("VCAP_SERVICES", `{"sentry": [{"name": "errors", "credentials": {}}]}`)
+		})
+
+		It("does not configure Sentry", func() {
+			Expect(sentry.BeforeCompile(stager)).To(Succeed())
+			Expect(supply.ExtraPackages()).To(BeEmpty())
+			Expect(buffer.String()).To(ContainSubstring("Sentry service errors has no dsn credential"))
+		})
+	})
+})
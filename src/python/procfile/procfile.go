@@ -0,0 +1,154 @@
+package procfile
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// EnvProcessTypes selects the process types that agent hooks wrap, as a
+// comma separated list. "*" selects all of them.
+const EnvProcessTypes = "BP_AGENT_PROCESS_TYPES"
+
+var processRegex = regexp.MustCompile(`^([A-Za-z0-9_-]+):\s*(.*)$`)
+
+// Procfile is a parsed Procfile. Comments and blank lines are kept, so that
+// rewriting a process leaves the rest of the file as it was.
+type Procfile struct {
+	lines           []line
+	trailingNewline bool
+}
+
+type line struct {
+	// text is the line as read, for comments and blank lines
+	text        string
+	processType string
+	command     string
+}
+
+func (l line) isProcess() bool {
+	return l.processType != ""
+}
+
+// Parse parses the contents of a Procfile.
+func Parse(contents string) (*Procfile, error) {
+	p := &Procfile{trailingNewline: strings.HasSuffix(contents, "\n")}
+
+	for _, text := range strings.Split(strings.TrimSuffix(contents, "\n"), "\n") {
+		text = strings.TrimSuffix(text, "\r")
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			p.lines = append(p.lines, line{text: text})
+			continue
+		}
+
+		match := processRegex.FindStringSubmatch(trimmed)
+		if match == nil {
+			return nil, errors.New("improper format found in Procfile")
+		}
+		p.lines = append(p.lines, line{processType: match[1], command: strings.TrimSpace(match[2])})
+	}
+
+	if len(p.lines) == 1 && p.lines[0].text == "" && !p.lines[0].isProcess() {
+		p.lines = nil
+	}
+	return p, nil
+}
+
+// Load reads and parses the Procfile at path.
+func Load(path string) (*Procfile, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(string(contents))
+}
+
+// Save writes the Procfile to path, keeping the mode of an existing file.
+func (p *Procfile) Save(path string) error {
+	mode := os.FileMode(0666)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	}
+	return os.WriteFile(path, []byte(p.String()), mode)
+}
+
+func (p *Procfile) String() string {
+	var lines []string
+	for _, l := range p.lines {
+		if l.isProcess() {
+			lines = append(lines, l.processType+": "+l.command)
+		} else {
+			lines = append(lines, l.text)
+		}
+	}
+
+	contents := strings.Join(lines, "\n")
+	if p.trailingNewline {
+		contents += "\n"
+	}
+	return contents
+}
+
+// ProcessTypes returns the process types in the order of the file.
+func (p *Procfile) ProcessTypes() []string {
+	var types []string
+	for _, l := range p.lines {
+		if l.isProcess() {
+			types = append(types, l.processType)
+		}
+	}
+	return types
+}
+
+// Command returns the command of a process type.
+func (p *Procfile) Command(processType string) (string, bool) {
+	for _, l := range p.lines {
+		if l.processType == processType {
+			return l.command, true
+		}
+	}
+	return "", false
+}
+
+// Wrap prefixes the commands of the given process types with a launcher,
+// e.g. "pyagent run --". "*" wraps every process. It returns the process
+// types that were wrapped; types missing from the Procfile are skipped.
+func (p *Procfile) Wrap(launcher string, processTypes ...string) []string {
+	all := false
+	selected := map[string]bool{}
+	for _, processType := range processTypes {
+		if processType == "*" {
+			all = true
+		}
+		selected[processType] = true
+	}
+
+	var wrapped []string
+	for i, l := range p.lines {
+		if !l.isProcess() || !(all || selected[l.processType]) {
+			continue
+		}
+		if !strings.HasPrefix(l.command, launcher+" ") {
+			p.lines[i].command = launcher + " " + l.command
+		}
+		wrapped = append(wrapped, l.processType)
+	}
+	return wrapped
+}
+
+// AgentProcessTypes returns the process types selected by
+// BP_AGENT_PROCESS_TYPES, defaulting to web.
+func AgentProcessTypes() []string {
+	var types []string
+	for _, processType := range strings.Split(os.Getenv(EnvProcessTypes), ",") {
+		if processType = strings.TrimSpace(processType); processType != "" {
+			types = append(types, processType)
+		}
+	}
+	if len(types) == 0 {
+		return []string{"web"}
+	}
+	return types
+}
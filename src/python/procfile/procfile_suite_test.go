@@ -0,0 +1,13 @@
+package procfile_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestProcfile(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Procfile Suite")
+}
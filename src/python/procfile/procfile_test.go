@@ -0,0 +1,117 @@
+package procfile_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/python-buildpack/src/python/procfile"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Procfile", func() {
+	const contents = `# processes of the app
+web: gunicorn app:app
+
+worker:   celery -A app worker
+clock: python clock.py
+`
+
+	Describe("Parse", func() {
+		It("returns the process types in order", func() {
+			p, err := procfile.Parse(contents)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.ProcessTypes()).To(Equal([]string{"web", "worker", "clock"}))
+
+			command, found := p.Command("worker")
+			Expect(found).To(BeTrue())
+			Expect(command).To(Equal("celery -A app worker"))
+		})
+
+		It("keeps comments and blank lines", func() {
+			p, err := procfile.Parse(contents)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.String()).To(Equal(`# processes of the app
+web: gunicorn app:app
+
+worker: celery -A app worker
+clock: python clock.py
+`))
+		})
+
+		It("accepts an empty Procfile", func() {
+			p, err := procfile.Parse("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.ProcessTypes()).To(BeEmpty())
+			Expect(p.String()).To(BeEmpty())
+		})
+
+		It("fails on a line without process type", func() {
+			_, err := procfile.Parse("web: python app.py\npython worker.py\n")
+			Expect(err).To(MatchError("improper format found in Procfile"))
+		})
+	})
+
+	Describe("Wrap", func() {
+		It("wraps the web process by default", func() {
+			p, err := procfile.Parse(contents)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(p.Wrap("pyagent run --", procfile.AgentProcessTypes()...)).To(Equal([]string{"web"}))
+			Expect(p.String()).To(Equal(`# processes of the app
+web: pyagent run -- gunicorn app:app
+
+worker: celery -A app worker
+clock: python clock.py
+`))
+		})
+
+		It("wraps the selected process types", func() {
+			DeferCleanup(os.Setenv, procfile.EnvProcessTypes, os.Getenv(procfile.EnvProcessTypes))
+			os.Setenv(procfile.EnvProcessTypes, "web, worker")
+
+			p, err := procfile.Parse(contents)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(p.Wrap("ddtrace-run", procfile.AgentProcessTypes()...)).To(Equal([]string{"web", "worker"}))
+			command, _ := p.Command("worker")
+			Expect(command).To(Equal("ddtrace-run celery -A app worker"))
+			command, _ = p.Command("clock")
+			Expect(command).To(Equal("python clock.py"))
+		})
+
+		It("wraps all processes with *", func() {
+			p, err := procfile.Parse(contents)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Wrap("ddtrace-run", "*")).To(Equal([]string{"web", "worker", "clock"}))
+		})
+
+		It("does not wrap a command twice", func() {
+			p, err := procfile.Parse("web: ddtrace-run python app.py")
+			Expect(err).NotTo(HaveOccurred())
+			p.Wrap("ddtrace-run", "web")
+			Expect(p.String()).To(Equal("web: ddtrace-run python app.py"))
+		})
+	})
+
+	Describe("Save", func() {
+		It("keeps the mode of the file", func() {
+			dir, err := os.MkdirTemp("", "procfile")
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(os.RemoveAll, dir)
+			path := filepath.Join(dir, "Procfile")
+			Expect(os.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+
+			p, err := procfile.Load(path)
+			Expect(err).NotTo(HaveOccurred())
+			p.Wrap("pyagent run --", "web")
+			Expect(p.Save(path)).To(Succeed())
+
+			info, err := os.Stat(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode()).To(Equal(os.FileMode(0600)))
+			Expect(os.ReadFile(path)).To(ContainSubstring("web: pyagent run -- gunicorn app:app"))
+		})
+	})
+})
@@ -7,11 +7,14 @@ import (
 	"strings"
 
 	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/python-buildpack/src/python/conda"
 )
 
 const requirementsParserRegex = `(?m)^[\w\-\w\[\]]+`
 
-type Reqs struct{}
+type Reqs struct {
+	Log *libbuildpack.Logger
+}
 
 func (m Reqs) FindAnyPackage(buildDir string, searchedPackages ...string) (bool, error) {
 	requirementsPath := filepath.Join(buildDir, "requirements.txt")
@@ -35,6 +38,20 @@ func (m Reqs) FindAnyPackage(buildDir string, searchedPackages ...string) (bool,
 		}
 	}
 
+	// A broken environment.yml fails the conda install with a better message,
+	// searching it is best effort.
+	envPackages, err := parseEnvironmentPackages(filepath.Join(buildDir, "environment.yml"))
+	if err != nil {
+		m.Log.Warning("Could not search environment.yml for %s: %v", strings.Join(searchedPackages, ", "), err)
+		return false, nil
+	}
+
+	for _, searchedPackage := range searchedPackages {
+		if containsPackage(envPackages, searchedPackage) {
+			return true, nil
+		}
+	}
+
 	return false, nil
 }
 
@@ -119,6 +136,38 @@ func parseRequirements(requirementsPath string) ([]string, error) {
 	return requirements, nil
 }
 
+// parseEnvironmentPackages returns the conda and pip packages of a conda
+// environment.yml, including requirement files referenced from its pip section.
+func parseEnvironmentPackages(environmentPath string) ([]string, error) {
+	if exists, err := libbuildpack.FileExists(environmentPath); err != nil || !exists {
+		return nil, err
+	}
+
+	env, err := conda.LoadEnvironment(environmentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	packages := env.PackageNames()
+
+	regex := regexp.MustCompile(requirementsParserRegex)
+	for _, entry := range env.Pip {
+		if !strings.HasPrefix(entry, "-") {
+			packages = append(packages, regex.FindString(strings.TrimSpace(entry)))
+		}
+	}
+
+	for _, file := range env.PipRequirementFiles() {
+		nestedPackages, err := parseRequirementsWithoutVersion(file)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, nestedPackages...)
+	}
+
+	return packages, nil
+}
+
 func parseRequirementsWithoutVersion(requirementsPath string) ([]string, error) {
 	parsedRequirements, err := parseRequirements(requirementsPath)
 	if err != nil {
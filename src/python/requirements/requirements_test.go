@@ -1,9 +1,13 @@
 package requirements
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
 
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/libbuildpack/ansicleaner"
+
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
@@ -12,6 +16,7 @@ var _ = Describe("Reqs", func() {
 	var (
 		tempDir string
 		req     Reqs
+		buffer  *bytes.Buffer
 		err     error
 	)
 
@@ -19,7 +24,8 @@ var _ = Describe("Reqs", func() {
 		tempDir, err = os.MkdirTemp("", "requirements")
 		Expect(err).NotTo(HaveOccurred())
 		DeferCleanup(os.RemoveAll, tempDir)
-		req = Reqs{}
+		buffer = new(bytes.Buffer)
+		req = Reqs{Log: libbuildpack.NewLogger(ansicleaner.New(buffer))}
 	})
 
 	Describe("FindAnyPackage", func() {
@@ -88,6 +94,58 @@ package4~=4.0.0
 				})
 
 			})
+
+			Context("conda environment.yml", func() {
+				BeforeEach(func() {
+					Expect(os.WriteFile(filepath.Join(tempDir, "environment.yml"), []byte(`name: app
+channels:
+  - conda-forge
+dependencies:
+  - python=3.11
+  - conda-forge::cffi>=1.15
+  - pip
+  - pip:
+    - package2>=2.0.0
+    - -r requirements-pip.txt
+`), 0644)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(tempDir, "requirements-pip.txt"), []byte(`Django==4.2`), 0644)).To(Succeed())
+				})
+
+				It("finds conda dependencies", func() {
+					exists, err := req.FindAnyPackage(tempDir, "cffi")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(exists).To(BeTrue())
+				})
+
+				It("finds packages of the pip section and its requirement files", func() {
+					exists, err := req.FindAnyPackage(tempDir, "package2")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(exists).To(BeTrue())
+
+					exists, err = req.FindAnyPackage(tempDir, "django", "Django")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(exists).To(BeTrue())
+				})
+
+				It("returns false for other packages", func() {
+					exists, err := req.FindAnyPackage(tempDir, "package1")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(exists).To(BeFalse())
+				})
+			})
+
+			Context("broken conda environment.yml", func() {
+				BeforeEach(func() {
+					Expect(os.WriteFile(filepath.Join(tempDir, "environment.yml"), []byte("dependencies: [\n"), 0644)).To(Succeed())
+				})
+
+				It("logs the error and returns false", func() {
+					exists, err := req.FindAnyPackage(tempDir, "cffi")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(exists).To(BeFalse())
+					Expect(buffer.String()).To(ContainSubstring("**WARNING** Could not search environment.yml for cffi"))
+				})
+			})
 		})
 	})
 
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Matcher describes how an integration recognises its service bindings. A
+// binding matches when any one of the criteria matches it.
+type Matcher struct {
+	// Labels are compared to the service label, e.g. "newrelic".
+	Labels []string
+	Tags   []string
+	// Names are compared to the binding and instance names.
+	Names []string
+	// NamePattern is matched against the label, and against the names of
+	// user-provided services, e.g. "app(-)?dynamics".
+	NamePattern *regexp.Regexp
+	// Types are compared to the type of SERVICE_BINDING_ROOT bindings.
+	Types []string
+}
+
+// Matches reports whether the service is selected by the matcher.
+func (m Matcher) Matches(service Service) bool {
+	if containsFold(m.Labels, service.Label) || containsFold(m.Types, service.Type) {
+		return true
+	}
+	for _, tag := range m.Tags {
+		if service.HasTag(tag) {
+			return true
+		}
+	}
+	for _, name := range service.names() {
+		if containsFold(m.Names, name) {
+			return true
+		}
+	}
+	if m.NamePattern == nil {
+		return false
+	} else if service.Label != "user-provided" {
+		return m.NamePattern.MatchString(service.Label)
+	}
+	for _, name := range service.names() {
+		if m.NamePattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolver selects service bindings for integrations.
+type Resolver struct {
+	Services []Service
+}
+
+// NewResolver loads the services bound to the app.
+func NewResolver() (*Resolver, error) {
+	services, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{Services: services}, nil
+}
+
+// All returns every service selected by the matcher.
+func (r *Resolver) All(m Matcher) []Service {
+	var matches []Service
+	for _, service := range r.Services {
+		if m.Matches(service) {
+			matches = append(matches, service)
+		}
+	}
+	return matches
+}
+
+// Find returns the one service selected by the matcher. found is false when
+// no service matches; an *AmbiguousError is returned when several do.
+func (r *Resolver) Find(m Matcher) (service Service, found bool, err error) {
+	matches := r.All(m)
+	switch len(matches) {
+	case 0:
+		return Service{}, false, nil
+	case 1:
+		return matches[0], true, nil
+	}
+	return Service{}, false, &AmbiguousError{Services: matches}
+}
+
+// AmbiguousError is returned when more than one binding could configure an
+// integration.
+type AmbiguousError struct {
+	Services []Service
+}
+
+func (e *AmbiguousError) Error() string {
+	var names []string
+	for _, service := range e.Services {
+		names = append(names, service.DisplayName())
+	}
+	return fmt.Sprintf("%d service bindings match, bind only one of: %s", len(e.Services), strings.Join(names, ", "))
+}
+
+// DisplayName names the service in log messages.
+func (s Service) DisplayName() string {
+	if names := s.names(); len(names) > 0 {
+		return names[0]
+	}
+	return s.Label
+}
+
+func (s Service) names() []string {
+	var names []string
+	for _, name := range []string{s.Name, s.InstanceName, s.BindingName} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func containsFold(values []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Service is a single service binding, either from VCAP_SERVICES or from a
+// binding directory below SERVICE_BINDING_ROOT.
+type Service struct {
+	Name         string                 `json:"name"`
+	InstanceName string                 `json:"instance_name"`
+	BindingName  string                 `json:"binding_name"`
+	Label        string                 `json:"label"`
+	Type         string                 `json:"-"`
+	Plan         string                 `json:"plan"`
+	Tags         []string               `json:"tags"`
+	Credentials  map[string]interface{} `json:"credentials"`
+}
+
+// Load returns all services bound to the app. It reads the file named by
+// VCAP_SERVICES_FILE_PATH (file-based service bindings), or VCAP_SERVICES
+// when that is not set, and the Kubernetes-style binding directories below
+// SERVICE_BINDING_ROOT. Both VCAP sources hold the same bindings, so only
+// one of them is read.
+func Load() ([]Service, error) {
+	var all []Service
+
+	if path := os.Getenv("VCAP_SERVICES_FILE_PATH"); path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read VCAP_SERVICES_FILE_PATH: %v", err)
+		}
+		services, err := parseVcapServices(contents)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %v", path, err)
+		}
+		all = append(all, services...)
+	} else if vcapServices := os.Getenv("VCAP_SERVICES"); vcapServices != "" {
+		services, err := parseVcapServices([]byte(vcapServices))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse VCAP_SERVICES: %v", err)
+		}
+		all = append(all, services...)
+	}
+
+	if root := os.Getenv("SERVICE_BINDING_ROOT"); root != "" {
+		services, err := loadBindingRoot(root)
+		if err != nil {
+			return nil, fmt.Errorf("could not read SERVICE_BINDING_ROOT: %v", err)
+		}
+		all = append(all, services...)
+	}
+
+	return all, nil
+}
+
+func parseVcapServices(contents []byte) ([]Service, error) {
+	byLabel := map[string][]Service{}
+	if err := json.Unmarshal(contents, &byLabel); err != nil {
+		return nil, err
+	}
+
+	var labels []string
+	for label := range byLabel {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var services []Service
+	for _, label := range labels {
+		for _, service := range byLabel[label] {
+			if service.Label == "" {
+				service.Label = label
+			}
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// loadBindingRoot reads one binding per directory. The "type" and "provider"
+// entries describe the binding, every other file is a credential.
+func loadBindingRoot(root string) ([]Service, error) {
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var services []Service
+	for _, entry := range entries {
+		dir := filepath.Join(root, entry.Name())
+		if info, err := os.Stat(dir); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			continue
+		}
+
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		service := Service{Name: entry.Name(), BindingName: entry.Name(), Credentials: map[string]interface{}{}}
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			contents, err := os.ReadFile(filepath.Join(dir, file.Name()))
+			if err != nil {
+				return nil, err
+			}
+			value := strings.TrimSpace(string(contents))
+
+			switch file.Name() {
+			case "type":
+				service.Type = value
+				service.Label = value
+			case "provider":
+				service.Plan = value
+			case "tags":
+				service.Tags = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' })
+			default:
+				service.Credentials[file.Name()] = value
+			}
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// Credential returns the first non-empty credential found under one of the
+// given keys. Numbers and booleans are formatted as strings.
+func (s Service) Credential(keys ...string) string {
+	for _, key := range keys {
+		switch value := s.Credentials[key].(type) {
+		case string:
+			if value != "" {
+				return value
+			}
+		case float64, bool:
+			return fmt.Sprint(value)
+		}
+	}
+	return ""
+}
+
+// CredentialList returns the credential under key as a list. It accepts JSON
+// arrays as well as comma or whitespace separated strings.
+func (s Service) CredentialList(key string) []string {
+	switch value := s.Credentials[key].(type) {
+	case []interface{}:
+		var list []string
+		for _, item := range value {
+			if str, ok := item.(string); ok && str != "" {
+				list = append(list, str)
+			}
+		}
+		return list
+	case string:
+		return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' })
+	}
+	return nil
+}
+
+func (s Service) HasTag(tag string) bool {
+	for _, t := range s.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
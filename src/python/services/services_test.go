@@ -0,0 +1,183 @@
+package services_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/cloudfoundry/python-buildpack/src/python/services"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Services", func() {
+	BeforeEach(func() {
+		for _, env := range []string{"VCAP_SERVICES", "VCAP_SERVICES_FILE_PATH", "SERVICE_BINDING_ROOT"} {
+			DeferCleanup(os.Setenv, env, os.Getenv(env))
+			Expect(os.Unsetenv(env)).To(Succeed())
+		}
+	})
+
+	Describe("Load", func() {
+		It("returns nothing when no services are bound", func() {
+			Expect(services.Load()).To(BeEmpty())
+		})
+
+		Context("VCAP_SERVICES is set", func() {
+			BeforeEach(func() {
+				Expect(os.Setenv("VCAP_SERVICES", `{
+					"user-provided": [{"name": "my-index", "tags": ["pypi"], "credentials": {"url": "https://pypi.example.com/simple", "port": 443}}],
+					"artifactory": [{"name": "other", "credentials": {}}]
+				}`)).To(Succeed())
+			})
+
+			It("returns every service sorted by label", func() {
+				bindings, err := services.Load()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(bindings).To(HaveLen(2))
+				Expect(bindings[0].Name).To(Equal("other"))
+				Expect(bindings[0].Label).To(Equal("artifactory"))
+				Expect(bindings[1].Name).To(Equal("my-index"))
+				Expect(bindings[1].Label).To(Equal("user-provided"))
+				Expect(bindings[1].HasTag("PyPI")).To(BeTrue())
+				Expect(bindings[1].Credential("uri", "url")).To(Equal("https://pypi.example.com/simple"))
+				Expect(bindings[1].Credential("port")).To(Equal("443"))
+			})
+		})
+
+		Context("VCAP_SERVICES is not valid JSON", func() {
+			BeforeEach(func() {
+				Expect(os.Setenv("VCAP_SERVICES", `{`)).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				_, err := services.Load()
+				Expect(err).To(MatchError(ContainSubstring("could not parse VCAP_SERVICES")))
+			})
+		})
+
+		Context("VCAP_SERVICES_FILE_PATH is set", func() {
+			BeforeEach(func() {
+				dir, err := os.MkdirTemp("", "services")
+				Expect(err).NotTo(HaveOccurred())
+				DeferCleanup(os.RemoveAll, dir)
+				Expect(os.WriteFile(filepath.Join(dir, "vcap_services.json"), []byte(`{"pypi": [{"name": "index", "credentials": {"url": "https://example.com"}}]}`), 0644)).To(Succeed())
+				Expect(os.Setenv("VCAP_SERVICES_FILE_PATH", filepath.Join(dir, "vcap_services.json"))).To(Succeed())
+			})
+
+			It("reads the services from the file", func() {
+				bindings, err := services.Load()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(bindings).To(HaveLen(1))
+				Expect(bindings[0].Label).To(Equal("pypi"))
+			})
+
+			It("ignores VCAP_SERVICES, which holds the same bindings", func() {
+				Expect(os.Setenv("VCAP_SERVICES", `{"pypi": [{"name": "index", "credentials": {"url": "https://example.com"}}]}`)).To(Succeed())
+
+				bindings, err := services.Load()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(bindings).To(HaveLen(1))
+			})
+		})
+
+		Context("SERVICE_BINDING_ROOT is set", func() {
+			BeforeEach(func() {
+				root, err := os.MkdirTemp("", "bindings")
+				Expect(err).NotTo(HaveOccurred())
+				DeferCleanup(os.RemoveAll, root)
+				Expect(os.Mkdir(filepath.Join(root, "my-index"), 0755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(root, "my-index", "type"), []byte("pypi\n"), 0644)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(root, "my-index", "url"), []byte("https://example.com/simple\n"), 0644)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(root, "my-index", "password"), []byte("secret"), 0644)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(root, "README"), []byte("not a binding"), 0644)).To(Succeed())
+				Expect(os.Setenv("SERVICE_BINDING_ROOT", root)).To(Succeed())
+			})
+
+			It("reads one service per binding directory", func() {
+				bindings, err := services.Load()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(bindings).To(HaveLen(1))
+				Expect(bindings[0].Name).To(Equal("my-index"))
+				Expect(bindings[0].Label).To(Equal("pypi"))
+				Expect(bindings[0].Type).To(Equal("pypi"))
+				Expect(bindings[0].Credential("url")).To(Equal("https://example.com/simple"))
+				Expect(bindings[0].Credential("password")).To(Equal("secret"))
+			})
+		})
+	})
+
+	Describe("CredentialList", func() {
+		It("accepts lists and separated strings", func() {
+			service := services.Service{Credentials: map[string]interface{}{
+				"list":   []interface{}{"a", "b"},
+				"string": "c, d",
+			}}
+			Expect(service.CredentialList("list")).To(Equal([]string{"a", "b"}))
+			Expect(service.CredentialList("string")).To(Equal([]string{"c", "d"}))
+			Expect(service.CredentialList("missing")).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("Resolver", func() {
+	var resolver *services.Resolver
+
+	BeforeEach(func() {
+		resolver = &services.Resolver{Services: []services.Service{
+			{Name: "apm", Label: "newrelic"},
+			{Name: "my-appdynamics", Label: "user-provided"},
+			{Name: "traces", Label: "user-provided", Tags: []string{"otel"}},
+			{Name: "collector", BindingName: "collector", Label: "opentelemetry", Type: "opentelemetry"},
+		}}
+	})
+
+	It("matches by label", func() {
+		service, found, err := resolver.Find(services.Matcher{Labels: []string{"NewRelic"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(service.Name).To(Equal("apm"))
+	})
+
+	It("matches user-provided services by name pattern", func() {
+		service, found, err := resolver.Find(services.Matcher{NamePattern: regexp.MustCompile("app(-)?dynamics")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(service.Name).To(Equal("my-appdynamics"))
+	})
+
+	It("only matches the names of user-provided services by name pattern", func() {
+		resolver.Services = append(resolver.Services, services.Service{Name: "appdynamics-db", Label: "mysql"})
+
+		Expect(resolver.All(services.Matcher{NamePattern: regexp.MustCompile("app(-)?dynamics")})).To(HaveLen(1))
+	})
+
+	It("matches the label by name pattern", func() {
+		service, found, err := resolver.Find(services.Matcher{NamePattern: regexp.MustCompile("new(-)?relic")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(service.Name).To(Equal("apm"))
+	})
+
+	It("matches by binding type", func() {
+		Expect(resolver.All(services.Matcher{Types: []string{"opentelemetry"}})).To(HaveLen(1))
+		Expect(resolver.All(services.Matcher{Types: []string{"newrelic"}})).To(BeEmpty())
+	})
+
+	It("reports when nothing matches", func() {
+		_, found, err := resolver.Find(services.Matcher{Names: []string{"sentry"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeFalse())
+	})
+
+	It("reports ambiguous matches", func() {
+		_, _, err := resolver.Find(services.Matcher{Tags: []string{"otel"}, Types: []string{"opentelemetry"}})
+		Expect(err).To(MatchError("2 service bindings match, bind only one of: traces, collector"))
+
+		var ambiguous *services.AmbiguousError
+		Expect(errors.As(err, &ambiguous)).To(BeTrue())
+		Expect(ambiguous.Services).To(HaveLen(2))
+	})
+})
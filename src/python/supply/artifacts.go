@@ -0,0 +1,450 @@
+package supply
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+const (
+	EnvArtifactsMirror = "BP_ARTIFACTS_MIRROR"
+
+	ArtifactURL         = "url"
+	ArtifactSpacy       = "spacy"
+	ArtifactHuggingFace = "huggingface"
+)
+
+// Large models can take a while to download, but a server that does not
+// respond must not hang staging. Downloads have no overall time limit, they
+// are aborted when no data arrives for artifactsIdleTimeout.
+const artifactsIdleTimeout = 2 * time.Minute
+
+var artifactsHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+}
+
+var (
+	artifactNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.\-]*$`)
+	envVarNameRegex   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Artifact is an entry of artifacts.yml: a file, archive or model the app
+// needs at runtime, pinned by checksum.
+//
+//	artifacts:
+//	- name: weights
+//	  url: https://example.com/model.tar.gz
+//	  sha256: ...
+//	  extract: true
+//	  env: MODEL_DIR
+//	- name: en_core_web_sm
+//	  type: spacy
+//	  version: 3.7.1
+//	  sha256: ...
+//	- name: minilm
+//	  type: huggingface
+//	  model: sentence-transformers/all-MiniLM-L6-v2
+//	  revision: c9745ed1d9f207416be6d2e6f8de32d1f16199bf
+//	  files:
+//	  - path: config.json
+//	    sha256: ...
+type Artifact struct {
+	Name    string `yaml:"name"`
+	Type    string `yaml:"type"`
+	URL     string `yaml:"url"`
+	SHA256  string `yaml:"sha256"`
+	Extract bool   `yaml:"extract"`
+	// Env names a variable that points to the artifact directory at runtime
+	Env      string         `yaml:"env"`
+	Model    string         `yaml:"model"`
+	Version  string         `yaml:"version"`
+	Revision string         `yaml:"revision"`
+	Files    []ArtifactFile `yaml:"files"`
+}
+
+type ArtifactFile struct {
+	Path   string `yaml:"path"`
+	SHA256 string `yaml:"sha256"`
+}
+
+type artifactsYml struct {
+	Artifacts []Artifact `yaml:"artifacts"`
+}
+
+// artifactDownload is a single file of an artifact.
+type artifactDownload struct {
+	url    string
+	sha256 string
+	// dest is relative to the artifact directory
+	dest string
+}
+
+func (a Artifact) kind() string {
+	if a.Type == "" {
+		return ArtifactURL
+	}
+	return a.Type
+}
+
+func (a Artifact) validate() error {
+	if !artifactNameRegex.MatchString(a.Name) {
+		return fmt.Errorf("artifact name %q may only contain letters, digits, '.', '_' and '-'", a.Name)
+	}
+	if a.Env != "" && !envVarNameRegex.MatchString(a.Env) {
+		return fmt.Errorf("artifact %s: %q is not a valid environment variable name", a.Name, a.Env)
+	}
+
+	switch a.kind() {
+	case ArtifactURL:
+		if a.URL == "" || a.SHA256 == "" {
+			return fmt.Errorf("artifact %s: url and sha256 are required", a.Name)
+		}
+		if name, err := urlFileName(a.URL); err != nil || name == "" {
+			return fmt.Errorf("artifact %s: url %s does not name a file", a.Name, stripCredentials(a.URL))
+		}
+	case ArtifactSpacy:
+		if a.Version == "" || a.SHA256 == "" {
+			return fmt.Errorf("artifact %s: version and sha256 are required for spacy models", a.Name)
+		}
+	case ArtifactHuggingFace:
+		if a.Model == "" || len(a.Files) == 0 {
+			return fmt.Errorf("artifact %s: model and files are required for huggingface models", a.Name)
+		}
+		for _, file := range a.Files {
+			if file.Path == "" || file.SHA256 == "" || strings.HasPrefix(path.Clean(file.Path), "..") || path.IsAbs(file.Path) {
+				return fmt.Errorf("artifact %s: every file needs a relative path and a sha256", a.Name)
+			}
+		}
+	default:
+		return fmt.Errorf("artifact %s: unknown type %q, use %s, %s or %s", a.Name, a.Type, ArtifactURL, ArtifactSpacy, ArtifactHuggingFace)
+	}
+	return nil
+}
+
+func (a Artifact) downloads() []artifactDownload {
+	switch a.kind() {
+	case ArtifactSpacy:
+		model := a.Model
+		if model == "" {
+			model = a.Name
+		}
+		wheel := fmt.Sprintf("%s-%s-py3-none-any.whl", model, a.Version)
+		return []artifactDownload{{
+			url:    fmt.Sprintf("https://github.com/explosion/spacy-models/releases/download/%s-%s/%s", model, a.Version, wheel),
+			sha256: a.SHA256,
+			dest:   wheel,
+		}}
+	case ArtifactHuggingFace:
+		endpoint := strings.TrimSuffix(os.Getenv("HF_ENDPOINT"), "/")
+		if endpoint == "" {
+			endpoint = "https://huggingface.co"
+		}
+		revision := a.Revision
+		if revision == "" {
+			revision = "main"
+		}
+		var downloads []artifactDownload
+		for _, file := range a.Files {
+			downloads = append(downloads, artifactDownload{
+				url:    fmt.Sprintf("%s/%s/resolve/%s/%s", endpoint, a.Model, revision, file.Path),
+				sha256: file.SHA256,
+				dest:   file.Path,
+			})
+		}
+		return downloads
+	default:
+		name, _ := urlFileName(a.URL)
+		return []artifactDownload{{url: a.URL, sha256: a.SHA256, dest: name}}
+	}
+}
+
+// urlFileName returns the last element of the path of rawURL, without the
+// query string and fragment, which may hold signed tokens.
+func urlFileName(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	switch name := path.Base(u.Path); name {
+	case ".", "/":
+		return "", nil
+	default:
+		return name, nil
+	}
+}
+
+func (s *Supplier) artifactsDir() string {
+	return filepath.Join(s.Stager.DepDir(), "artifacts")
+}
+
+// PrefetchArtifacts downloads the artifacts listed in artifacts.yml into the
+// dep dir. Files are verified against their sha256 and kept in the cache,
+// keyed by checksum. A file shipped in the artifacts directory of the app or
+// found below BP_ARTIFACTS_MIRROR (by its path in the artifact) is used
+// instead of the original URL. spaCy models are installed with pip.
+func (s *Supplier) PrefetchArtifacts() error {
+	artifactsPath := filepath.Join(s.Stager.BuildDir(), "artifacts.yml")
+	if exists, err := libbuildpack.FileExists(artifactsPath); err != nil {
+		return err
+	} else if !exists {
+		return nil
+	}
+
+	var config artifactsYml
+	if err := libbuildpack.NewYAML().Load(artifactsPath, &config); err != nil {
+		return fmt.Errorf("could not parse artifacts.yml: %v", err)
+	}
+
+	seen := map[string]bool{}
+	for _, artifact := range config.Artifacts {
+		if err := artifact.validate(); err != nil {
+			return err
+		}
+		if seen[artifact.Name] {
+			return fmt.Errorf("artifact %s is listed twice", artifact.Name)
+		}
+		seen[artifact.Name] = true
+	}
+
+	s.Log.BeginStep("Prefetching artifacts")
+
+	scriptContents := fmt.Sprintf("export ARTIFACTS_DIR=$DEPS_DIR/%s/artifacts\n", s.Stager.DepsIdx())
+	if err := s.Stager.WriteEnvFile("ARTIFACTS_DIR", s.artifactsDir()); err != nil {
+		return err
+	}
+
+	usedCacheFiles := map[string]bool{}
+	for _, artifact := range config.Artifacts {
+		s.Log.Info("%s (%s)", artifact.Name, artifact.kind())
+		artifactDir := filepath.Join(s.artifactsDir(), artifact.Name)
+		if err := os.MkdirAll(artifactDir, 0755); err != nil {
+			return err
+		}
+
+		for _, download := range artifact.downloads() {
+			usedCacheFiles[strings.ToLower(download.sha256)] = true
+			file, err := s.fetchArtifact(download)
+			if err != nil {
+				return fmt.Errorf("could not fetch artifact %s: %v", artifact.Name, err)
+			}
+
+			dest := filepath.Join(artifactDir, filepath.FromSlash(download.dest))
+			if artifact.Extract {
+				err = extractArtifact(file, download.dest, artifactDir)
+			} else if err = os.MkdirAll(filepath.Dir(dest), 0755); err == nil {
+				err = libbuildpack.CopyFile(file, dest)
+			}
+			if err != nil {
+				return fmt.Errorf("could not install artifact %s: %v", artifact.Name, err)
+			}
+
+			if artifact.kind() == ArtifactSpacy {
+				if err := s.runPipInstall(dest, "--no-deps", "--disable-pip-version-check", "--no-warn-script-location"); err != nil {
+					return fmt.Errorf("could not install spacy model %s: %v", artifact.Name, err)
+				}
+			}
+		}
+
+		if artifact.Env != "" {
+			if err := s.Stager.WriteEnvFile(artifact.Env, artifactDir); err != nil {
+				return err
+			}
+			scriptContents += fmt.Sprintf("export %s=$DEPS_DIR/%s/artifacts/%s\n", artifact.Env, s.Stager.DepsIdx(), artifact.Name)
+		}
+	}
+
+	if err := s.pruneArtifactCache(usedCacheFiles); err != nil {
+		s.Log.Warning("Could not prune artifact cache: %v", err)
+	}
+
+	return s.Stager.WriteProfileD("artifacts.sh", scriptContents)
+}
+
+// fetchArtifact returns a local, verified copy of the download.
+func (s *Supplier) fetchArtifact(download artifactDownload) (string, error) {
+	sha := strings.ToLower(download.sha256)
+	cached := filepath.Join(s.Stager.CacheDir(), "artifacts", sha)
+	if exists, err := libbuildpack.FileExists(cached); err != nil {
+		return "", err
+	} else if exists {
+		if err := checkSha256(cached, sha); err == nil {
+			s.Log.Debug("Using cached %s", download.dest)
+			return cached, nil
+		}
+		os.Remove(cached)
+	}
+
+	// Files of a Hugging Face model can share a name in different
+	// directories, so they are looked up by their path.
+	name := download.dest
+	vendored := filepath.Join(s.Stager.BuildDir(), "artifacts", filepath.FromSlash(name))
+	if exists, err := libbuildpack.FileExists(vendored); err != nil {
+		return "", err
+	} else if exists {
+		if err := checkSha256(vendored, sha); err != nil {
+			return "", fmt.Errorf("vendored %s: %v", name, err)
+		}
+		s.Log.Debug("Using vendored %s", name)
+		return vendored, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		return "", err
+	}
+
+	sources := []string{download.url}
+	if mirror := strings.TrimSuffix(os.Getenv(EnvArtifactsMirror), "/"); mirror != "" {
+		sources = append([]string{mirror + "/" + (&url.URL{Path: name}).EscapedPath()}, sources...)
+	}
+
+	var lastErr error
+	for _, source := range sources {
+		s.Log.Debug("Downloading %s", stripCredentials(source))
+		var actual string
+		if actual, lastErr = downloadFile(source, cached+".tmp"); lastErr == nil {
+			if lastErr = compareSha256(sha, actual); lastErr == nil {
+				return cached, os.Rename(cached+".tmp", cached)
+			}
+		}
+		os.Remove(cached + ".tmp")
+		s.Log.Debug("Could not fetch %s: %v", stripCredentials(source), lastErr)
+	}
+	return "", lastErr
+}
+
+// pruneArtifactCache removes cached files that artifacts.yml no longer lists.
+func (s *Supplier) pruneArtifactCache(used map[string]bool) error {
+	entries, err := os.ReadDir(filepath.Join(s.Stager.CacheDir(), "artifacts"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !used[entry.Name()] {
+			if err := os.RemoveAll(filepath.Join(s.Stager.CacheDir(), "artifacts", entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// downloadFile writes source to dest and returns the sha256 of its contents.
+func downloadFile(source, dest string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idle := time.AfterFunc(artifactsIdleTimeout, cancel)
+	defer idle.Stop()
+
+	var body io.ReadCloser
+	switch u.Scheme {
+	case "file":
+		if body, err = os.Open(u.Path); err != nil {
+			return "", err
+		}
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return "", fmt.Errorf("%v", redact(err.Error()))
+		}
+		resp, err := artifactsHTTPClient.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("%v", redact(err.Error()))
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", fmt.Errorf("could not download: %s", resp.Status)
+		}
+		body = resp.Body
+	default:
+		return "", fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	defer body.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), idleTimeoutReader{body, idle}); err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("download stalled, no data for %s", artifactsIdleTimeout)
+		}
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), out.Close()
+}
+
+// idleTimeoutReader pushes the idle deadline of a download back whenever
+// data arrives.
+type idleTimeoutReader struct {
+	io.Reader
+	idle *time.Timer
+}
+
+func (r idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.idle.Reset(artifactsIdleTimeout)
+	return n, err
+}
+
+// checkSha256 verifies a file without reading it into memory, as models can
+// be several gigabytes.
+func checkSha256(file, expected string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	return compareSha256(expected, hex.EncodeToString(hash.Sum(nil)))
+}
+
+func compareSha256(expected, actual string) error {
+	if !strings.EqualFold(expected, actual) {
+		return fmt.Errorf("sha256 mismatch: expected sha256 %s, actual sha256 %s", expected, actual)
+	}
+	return nil
+}
+
+func extractArtifact(file, name, destDir string) error {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return libbuildpack.ExtractZip(file, destDir)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return libbuildpack.ExtractTarGz(file, destDir)
+	default:
+		return fmt.Errorf("cannot extract %s, only .zip, .tar.gz and .tgz archives are supported", name)
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"path/filepath"
 	"time"
 
-	_ "github.com/cloudfoundry/python-buildpack/src/python/hooks"
+	"github.com/cloudfoundry/python-buildpack/src/python/hooks"
 	"github.com/cloudfoundry/python-buildpack/src/python/requirements"
 	"github.com/cloudfoundry/python-buildpack/src/python/supply"
 
@@ -78,7 +78,8 @@ func main() {
 		Installer:    installer,
 		Log:          logger,
 		Command:      &libbuildpack.Command{},
-		Requirements: requirements.Reqs{},
+		Requirements: requirements.Reqs{Log: logger},
+		AppHooks:     hooks.AppHookRunner{Stager: stager},
 	}
 
 	err = supply.Run(&s)
@@ -86,7 +87,7 @@ func main() {
 		os.Exit(14)
 	}
 
-	if err := stager.WriteConfigYml(nil); err != nil {
+	if err := stager.WriteConfigYml(s.BuildReport()); err != nil {
 		logger.Error("Error writing config.yml: %s", err.Error())
 		os.Exit(15)
 	}
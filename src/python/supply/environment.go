@@ -0,0 +1,111 @@
+package supply
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/python-buildpack/src/python/conda"
+)
+
+const (
+	EnvironmentPip   = "pip"
+	EnvironmentConda = "conda"
+
+	EnvCondaPipInstall = "BP_CONDA_PIP_INSTALL"
+)
+
+// Environment is the Python installation the app is staged into: the
+// buildpack's own interpreter with pip, or a conda environment. The zero
+// value is the pip environment.
+type Environment struct {
+	Kind string
+	// Python is the interpreter to run during staging
+	Python string
+	// BinDir holds the console scripts of the installed packages
+	BinDir string
+}
+
+// NewCondaEnvironment describes the dep_env environment created by conda.Run.
+func NewCondaEnvironment(c *conda.Conda) Environment {
+	return Environment{
+		Kind:   EnvironmentConda,
+		Python: c.Python(),
+		BinDir: filepath.Dir(c.Python()),
+	}
+}
+
+func (e Environment) IsConda() bool {
+	return e.Kind == EnvironmentConda
+}
+
+func (s *Supplier) python() string {
+	if s.Environment.Python == "" {
+		return "python"
+	}
+	return s.Environment.Python
+}
+
+func (s *Supplier) binDir() string {
+	if s.Environment.BinDir == "" {
+		return filepath.Join(s.Stager.DepDir(), "bin")
+	}
+	return s.Environment.BinDir
+}
+
+// linkScripts links the console scripts of the installed packages into the
+// bin directory of the dep dir.
+func (s *Supplier) linkScripts() error {
+	if s.Environment.IsConda() {
+		return s.Stager.LinkDirectoryInDepDir(s.Environment.BinDir, "bin")
+	}
+	return s.Stager.LinkDirectoryInDepDir(filepath.Join(s.Stager.DepDir(), "python", "bin"), "bin")
+}
+
+// InstallPipRequirementsIntoConda installs requirements.txt, or the
+// requirements derived from Pipfile.lock or setup.py, into the conda
+// environment with the environment's pip. Vendored packages, package indexes
+// and constraints are handled as for pip apps.
+func (s *Supplier) InstallPipRequirementsIntoConda() error {
+	if err := s.SetupCacheDir(); err != nil {
+		return err
+	}
+
+	requirementsExists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), "requirements.txt"))
+	if err != nil {
+		return err
+	}
+
+	if !requirementsExists {
+		if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), "Pipfile.lock")); err != nil {
+			return err
+		} else if exists {
+			s.Log.Info("Generating 'requirements.txt' from Pipfile.lock")
+			requirementsContents, err := pipfileToRequirements(filepath.Join(s.Stager.BuildDir(), "Pipfile.lock"))
+			if err != nil {
+				return fmt.Errorf("failed to write `requirement.txt` from Pipfile.lock: %s", err.Error())
+			}
+			if err := s.writeTempRequirementsTxt(requirementsContents); err != nil {
+				return err
+			}
+		} else if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), "Pipfile")); err != nil {
+			return err
+		} else if exists {
+			s.Log.Warning("A Pipfile without Pipfile.lock cannot be installed into a conda environment. Run 'pipenv lock' and push Pipfile.lock")
+		}
+	}
+
+	if err := s.HandleRequirementstxt(); err != nil {
+		return err
+	}
+
+	vendored, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), "vendor"))
+	if err != nil {
+		return fmt.Errorf("could not check vendor existence: %v", err)
+	}
+
+	if vendored {
+		return s.RunPipVendored()
+	}
+	return s.RunPipUnvendored()
+}
@@ -0,0 +1,133 @@
+package supply
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// ExtraPackage is a package an integration needs in the app's environment,
+// such as an APM agent.
+type ExtraPackage struct {
+	Name string `yaml:"name"`
+	// Version is a version specifier, e.g. "==9.1.0" or ">=2". A bare
+	// version pins that version.
+	Version string `yaml:"version,omitempty"`
+	// IndexURL is an additional package index that serves the package.
+	IndexURL string `yaml:"index_url,omitempty"`
+	// Source names the integration that requested the package.
+	Source string `yaml:"source,omitempty"`
+}
+
+// Requirement returns the package as a pip requirement.
+func (p ExtraPackage) Requirement() string {
+	version := strings.TrimSpace(p.Version)
+	if version != "" && strings.IndexAny(version[:1], "=<>!~") == -1 {
+		version = "==" + version
+	}
+	return p.Name + version
+}
+
+var (
+	extraPackagesLock sync.Mutex
+	extraPackages     []ExtraPackage
+)
+
+// AddExtraPackage adds a package to the ones installed after the app's own
+// requirements. Integrations use it instead of editing the app's
+// requirements.txt. A package added twice is installed once; the first pin
+// wins.
+func AddExtraPackage(pkg ExtraPackage) {
+	extraPackagesLock.Lock()
+	defer extraPackagesLock.Unlock()
+	for i, existing := range extraPackages {
+		if strings.EqualFold(existing.Name, pkg.Name) {
+			if existing.Version == "" {
+				extraPackages[i].Version = pkg.Version
+			}
+			if existing.IndexURL == "" {
+				extraPackages[i].IndexURL = pkg.IndexURL
+			}
+			return
+		}
+	}
+	extraPackages = append(extraPackages, pkg)
+}
+
+func ExtraPackages() []ExtraPackage {
+	extraPackagesLock.Lock()
+	defer extraPackagesLock.Unlock()
+	return append([]ExtraPackage{}, extraPackages...)
+}
+
+func ClearExtraPackages() {
+	extraPackagesLock.Lock()
+	extraPackages = nil
+	extraPackagesLock.Unlock()
+}
+
+// InstallExtraPackages installs the packages added with AddExtraPackage into
+// the staged environment, in a pip run of their own so that they do not
+// change how the app's requirements are resolved. Vendored apps install them
+// from vendor without an index, like their own requirements, unless a
+// package names the index that serves it.
+func (s *Supplier) InstallExtraPackages() error {
+	packages := ExtraPackages()
+	if len(packages) == 0 {
+		return nil
+	}
+
+	s.Log.BeginStep("Installing extra packages")
+
+	installArgs := []string{
+		"--exists-action=w",
+		"--disable-pip-version-check",
+		"--no-warn-script-location",
+	}
+
+	indexURLs := map[string]bool{}
+	var indexArgs, requirements []string
+	for _, pkg := range packages {
+		if pkg.IndexURL != "" && !indexURLs[pkg.IndexURL] {
+			indexURLs[pkg.IndexURL] = true
+			indexArgs = append(indexArgs, "--extra-index-url", pkg.IndexURL)
+		}
+		requirements = append(requirements, pkg.Requirement())
+		if pkg.Source != "" {
+			s.Log.Info("%s (for %s)", pkg.Requirement(), pkg.Source)
+		}
+	}
+
+	vendorDir := filepath.Join(s.Stager.BuildDir(), "vendor")
+	if vendored, err := libbuildpack.FileExists(vendorDir); err != nil {
+		return fmt.Errorf("could not check vendor existence: %v", err)
+	} else if vendored {
+		if len(indexArgs) == 0 {
+			installArgs = append(installArgs, "--no-index")
+		}
+		installArgs = append(installArgs, "--find-links=file://"+vendorDir)
+	}
+	installArgs = append(installArgs, indexArgs...)
+
+	installArgs = append(append(installArgs, s.constraintArgs()...), requirements...)
+	if err := s.runPipInstall(installArgs...); err != nil {
+		s.reportConstraintConflict()
+		return fmt.Errorf("could not run pip: %v", err)
+	}
+	s.installedExtraPackages = packages
+
+	return s.linkScripts()
+}
+
+// BuildReport describes what staging added to the app beyond its own
+// dependencies. It is recorded in the config.yml of the deps dir.
+func (s *Supplier) BuildReport() map[string]interface{} {
+	report := map[string]interface{}{}
+	if len(s.installedExtraPackages) > 0 {
+		report["extra_packages"] = s.installedExtraPackages
+	}
+	return report
+}
@@ -0,0 +1,176 @@
+package supply
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/python-buildpack/src/python/services"
+)
+
+// Services tagged, labelled, named or typed like this provide package indexes
+// for pip.
+var packageIndexServiceTags = []string{"pip-index", "pypi"}
+
+var packageIndexMatcher = services.Matcher{
+	Labels: packageIndexServiceTags,
+	Tags:   packageIndexServiceTags,
+	Names:  packageIndexServiceTags,
+	Types:  packageIndexServiceTags,
+}
+
+// urlCredentialsRegex matches the user info of URLs, up to the last "@" of
+// the authority, so that passwords with an "@" are covered as a whole.
+var urlCredentialsRegex = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/\s]*@`)
+
+type packageIndex struct {
+	service  string
+	url      *url.URL
+	username string
+	password string
+}
+
+// SetupPackageIndexes configures pip to use the package indexes of bound
+// services. Credentials are written to a .netrc outside of the build and deps
+// dirs and are only visible to this staging process.
+func (s *Supplier) SetupPackageIndexes() error {
+	resolver, err := services.NewResolver()
+	if err != nil {
+		s.Log.Warning("Could not load service bindings, package index services are ignored: %v", err)
+		return nil
+	}
+
+	var indexes []packageIndex
+	for _, binding := range resolver.All(packageIndexMatcher) {
+		rawURL := binding.Credential("url", "uri", "index_url", "index-url")
+		if rawURL == "" {
+			s.Log.Warning("Service %s is tagged as a package index but has no url credential, ignoring it", binding.Name)
+			continue
+		}
+		indexURL, err := url.Parse(rawURL)
+		if err != nil || indexURL.Host == "" {
+			s.Log.Warning("Service %s has an invalid package index url, ignoring it", binding.Name)
+			continue
+		}
+
+		index := packageIndex{
+			service:  binding.Name,
+			username: binding.Credential("username", "user", "login"),
+			password: binding.Credential("password", "token", "api_key", "apikey"),
+		}
+		if indexURL.User != nil {
+			if index.username == "" {
+				index.username = indexURL.User.Username()
+			}
+			if password, ok := indexURL.User.Password(); ok && index.password == "" {
+				index.password = password
+			}
+			indexURL.User = nil
+		}
+		index.url = indexURL
+		indexes = append(indexes, index)
+	}
+
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	if !s.appIndexesAllowed() {
+		s.Log.Warning("Ignoring package index services, the platform operator only allows the configured mirrors")
+		return nil
+	}
+
+	sort.SliceStable(indexes, func(i, j int) bool { return indexes[i].service < indexes[j].service })
+
+	// Operator mirrors stay in place, the indexes of the services are added
+	// to them.
+	indexURL := s.mirrors.IndexURL
+	extraIndexURLs := append([]string{}, s.mirrors.ExtraIndexURLs...)
+	netrc := &strings.Builder{}
+	for _, index := range indexes {
+		s.Log.Info("Using package index %s from service %s", index.url.String(), index.service)
+		if indexURL == "" {
+			indexURL = index.url.String()
+		} else {
+			extraIndexURLs = append(extraIndexURLs, index.url.String())
+		}
+		if index.username != "" || index.password != "" {
+			fmt.Fprintf(netrc, "machine %s\n  login %s\n  password %s\n", index.url.Hostname(), index.username, index.password)
+		}
+	}
+	if err := os.Setenv("PIP_INDEX_URL", indexURL); err != nil {
+		return err
+	}
+	if len(extraIndexURLs) > 0 {
+		if err := os.Setenv("PIP_EXTRA_INDEX_URL", strings.Join(extraIndexURLs, " ")); err != nil {
+			return err
+		}
+	}
+
+	if netrc.Len() == 0 {
+		return nil
+	}
+
+	credentialsDir, err := s.stagingConfigDir()
+	if err != nil {
+		return err
+	}
+
+	netrcPath := filepath.Join(credentialsDir, ".netrc")
+	if err := os.WriteFile(netrcPath, []byte(netrc.String()), 0600); err != nil {
+		return err
+	}
+	return os.Setenv("NETRC", netrcPath)
+}
+
+// redact replaces the user info of every URL in s, which is where pip and
+// its configuration carry credentials, e.g. "https://***@host/simple".
+func redact(s string) string {
+	return urlCredentialsRegex.ReplaceAllString(s, "${1}***@")
+}
+
+// stripCredentials removes the user info from a URL, leaving anything that
+// does not parse as a URL untouched.
+func stripCredentials(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.User == nil {
+		return rawURL
+	}
+	parsed.User = nil
+	return parsed.String()
+}
+
+// redactingWriter redacts output line by line, so that a URL split across
+// writes is still recognised. Flush writes a last line without a newline.
+type redactingWriter struct {
+	writer  io.Writer
+	pending []byte
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	end := bytes.LastIndexAny(w.pending, "\r\n")
+	if end < 0 {
+		return len(p), nil
+	}
+	if _, err := w.writer.Write([]byte(redact(string(w.pending[:end+1])))); err != nil {
+		return 0, err
+	}
+	w.pending = append(w.pending[:0], w.pending[end+1:]...)
+	return len(p), nil
+}
+
+func (w *redactingWriter) Flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	_, err := w.writer.Write([]byte(redact(string(w.pending))))
+	w.pending = nil
+	return err
+}
@@ -0,0 +1,156 @@
+package supply
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// nltkCollections are downloader ids that stand for many packages; they are
+// not verified individually.
+var nltkCollections = map[string]bool{
+	"all": true, "all-corpora": true, "all-nltk": true, "book": true, "popular": true, "tests": true, "third-party": true,
+}
+
+func (s *Supplier) nltkDataDir() string {
+	return filepath.Join(s.Stager.DepDir(), "python", "nltk_data")
+}
+
+// nltkCacheKey identifies the corpora of nltk.txt independent of the order
+// and whitespace of the file.
+func nltkCacheKey(corpora []string) string {
+	sorted := append([]string{}, corpora...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// findNltkPackage returns the paths of a downloader package in an nltk_data
+// directory: the unpacked directory and/or the zip file below its category,
+// e.g. corpora/brown and corpora/brown.zip.
+func findNltkPackage(dataDir, id string) ([]string, error) {
+	var found []string
+	for _, pattern := range []string{id, id + ".zip", id + ".pickle"} {
+		matches, err := filepath.Glob(filepath.Join(dataDir, "*", pattern))
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, matches...)
+	}
+	return found, nil
+}
+
+// restoreNltkCache copies the corpora cached for the key into the dep dir.
+func (s *Supplier) restoreNltkCache(key string) (bool, error) {
+	cached := filepath.Join(s.Stager.CacheDir(), "nltk_data", key)
+	if exists, err := libbuildpack.FileExists(cached); err != nil || !exists {
+		return false, err
+	}
+
+	if err := os.MkdirAll(s.nltkDataDir(), 0755); err != nil {
+		return false, err
+	}
+	return true, libbuildpack.CopyDirectory(cached, s.nltkDataDir())
+}
+
+// saveNltkCache replaces the cached corpora with those in the dep dir.
+func (s *Supplier) saveNltkCache(key string) error {
+	cacheDir := filepath.Join(s.Stager.CacheDir(), "nltk_data")
+	if err := os.RemoveAll(cacheDir); err != nil {
+		return err
+	}
+
+	tmpDir := filepath.Join(cacheDir, ".save")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	if err := libbuildpack.CopyDirectory(s.nltkDataDir(), tmpDir); err != nil {
+		os.RemoveAll(cacheDir)
+		return err
+	}
+	return os.Rename(tmpDir, filepath.Join(cacheDir, key))
+}
+
+// copyVendoredNltkData copies the corpora the app ships in its nltk_data
+// directory, replacing any copy restored from the cache, and returns the ids
+// that still need to be downloaded.
+func (s *Supplier) copyVendoredNltkData(corpora []string) ([]string, error) {
+	vendorDir := filepath.Join(s.Stager.BuildDir(), "nltk_data")
+	if exists, err := libbuildpack.FileExists(vendorDir); err != nil {
+		return nil, err
+	} else if !exists {
+		return corpora, nil
+	}
+
+	var missing []string
+	for _, id := range corpora {
+		paths, err := findNltkPackage(vendorDir, id)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			missing = append(missing, id)
+			continue
+		}
+
+		s.Log.Info("Using vendored NLTK package %s", id)
+		for _, path := range paths {
+			rel, err := filepath.Rel(vendorDir, path)
+			if err != nil {
+				return nil, err
+			}
+			dest := filepath.Join(s.nltkDataDir(), rel)
+			if err := os.RemoveAll(dest); err != nil {
+				return nil, err
+			}
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return nil, err
+			}
+			if info, err := os.Stat(path); err != nil {
+				return nil, err
+			} else if info.IsDir() {
+				if err := os.MkdirAll(dest, 0755); err != nil {
+					return nil, err
+				}
+				if err := libbuildpack.CopyDirectory(path, dest); err != nil {
+					return nil, err
+				}
+			} else if err := libbuildpack.CopyFile(path, dest); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return missing, nil
+}
+
+// verifyNltkData checks that every package of nltk.txt ended up in the dep
+// dir. nltk.downloader only prints an error for ids it does not know.
+func (s *Supplier) verifyNltkData(corpora []string) error {
+	var missing []string
+	for _, id := range corpora {
+		if nltkCollections[id] {
+			continue
+		}
+		paths, err := findNltkPackage(s.nltkDataDir(), id)
+		if err != nil {
+			return err
+		}
+		if len(paths) == 0 {
+			missing = append(missing, id)
+		}
+	}
+
+	if len(missing) > 0 {
+		s.Log.Error("NLTK packages not found: %s\n\n"+
+			"       Check nltk.txt for typos, the ids are listed at https://www.nltk.org/nltk_data/.\n"+
+			"       Without internet access, ship the packages in the nltk_data directory of the app.", strings.Join(missing, ", "))
+		return fmt.Errorf("unknown NLTK packages: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package supply
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+const (
+	EnvPipConstraints    = "BP_PIP_CONSTRAINTS"
+	EnvPipIndexURL       = "BP_PIP_INDEX_URL"
+	EnvPipExtraIndexURLs = "BP_PIP_EXTRA_INDEX_URLS"
+	EnvPipTrustedHosts   = "BP_PIP_TRUSTED_HOSTS"
+	EnvCondaChannels     = "BP_CONDA_CHANNELS"
+	EnvCondaChannelAlias = "BP_CONDA_CHANNEL_ALIAS"
+)
+
+var (
+	appIndexRegex           = regexp.MustCompile(`(?m)^\s*(-i|--index-url|--extra-index-url)(\s*=\s*|\s+|\S).*$`)
+	requirementIncludeRegex = regexp.MustCompile(`(?m)^\s*(?:-r|--requirement)(?:\s*=\s*|\s+)?(\S+)\s*$`)
+)
+
+// operatorConfig is the python section of the override.yml files that
+// operators ship through the override buildpack, e.g.
+//
+//	python:
+//	  pip:
+//	    constraints:
+//	    - urllib3>=2.2.2
+//	    constraints_files:
+//	    - https://internal.example.com/python/constraints.txt
+//	  mirrors:
+//	    index_url: https://pypi.internal.example.com/simple
+//	    conda_channel_alias: https://conda.internal.example.com
+//	    allow_app_indexes: false
+type operatorConfig struct {
+	Pip struct {
+		Constraints      []string `yaml:"constraints"`
+		ConstraintsFiles []string `yaml:"constraints_files"`
+	} `yaml:"pip"`
+	Mirrors packageMirrors `yaml:"mirrors"`
+}
+
+type packageMirrors struct {
+	IndexURL          string   `yaml:"index_url"`
+	ExtraIndexURLs    []string `yaml:"extra_index_urls"`
+	TrustedHosts      []string `yaml:"trusted_hosts"`
+	CondaChannels     []string `yaml:"conda_channels"`
+	CondaChannelAlias string   `yaml:"conda_channel_alias"`
+	AllowAppIndexes   *bool    `yaml:"allow_app_indexes"`
+}
+
+func (m packageMirrors) configured() bool {
+	return m.IndexURL != "" || len(m.ExtraIndexURLs) > 0 || len(m.CondaChannels) > 0 || m.CondaChannelAlias != ""
+}
+
+// LoadOperatorConfig reads the settings operators apply to every app: the
+// python section of override.yml files in the deps dir and BP_PIP_CONSTRAINTS,
+// which can be set through environment variable groups.
+func (s *Supplier) LoadOperatorConfig() error {
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(s.Stager.DepDir()), "*", "override.yml"))
+	if err != nil {
+		return err
+	}
+
+	var inlineConstraints []string
+	for _, file := range files {
+		overrideYml := map[string]operatorConfig{}
+		if err := libbuildpack.NewYAML().Load(file, &overrideYml); err != nil {
+			return fmt.Errorf("could not parse %s: %v", file, err)
+		}
+		config := overrideYml["python"]
+		inlineConstraints = append(inlineConstraints, config.Pip.Constraints...)
+		s.constraintsFiles = append(s.constraintsFiles, config.Pip.ConstraintsFiles...)
+		s.mirrors.merge(config.Mirrors)
+	}
+
+	s.constraintsFiles = append(s.constraintsFiles, splitList(os.Getenv(EnvPipConstraints))...)
+
+	// Environment variable groups can provide mirrors as well. Apps can
+	// override group variables, so only override.yml reliably restricts apps
+	// to the mirrors.
+	s.mirrors.merge(packageMirrors{
+		IndexURL:          os.Getenv(EnvPipIndexURL),
+		ExtraIndexURLs:    splitList(os.Getenv(EnvPipExtraIndexURLs)),
+		TrustedHosts:      splitList(os.Getenv(EnvPipTrustedHosts)),
+		CondaChannels:     splitList(os.Getenv(EnvCondaChannels)),
+		CondaChannelAlias: os.Getenv(EnvCondaChannelAlias),
+	})
+
+	if len(inlineConstraints) > 0 {
+		dir, err := s.stagingConfigDir()
+		if err != nil {
+			return err
+		}
+		constraintsFile := filepath.Join(dir, "operator-constraints.txt")
+		if err := os.WriteFile(constraintsFile, []byte(strings.Join(inlineConstraints, "\n")+"\n"), 0644); err != nil {
+			return err
+		}
+		s.constraintsFiles = append(s.constraintsFiles, constraintsFile)
+	}
+
+	if len(s.constraintsFiles) > 0 {
+		s.Log.Info("Applying operator constraints from %s", strings.Join(s.constraintsFiles, ", "))
+	}
+
+	return nil
+}
+
+func (m *packageMirrors) merge(other packageMirrors) {
+	if other.IndexURL != "" {
+		m.IndexURL = other.IndexURL
+	}
+	if len(other.ExtraIndexURLs) > 0 {
+		m.ExtraIndexURLs = other.ExtraIndexURLs
+	}
+	if len(other.TrustedHosts) > 0 {
+		m.TrustedHosts = other.TrustedHosts
+	}
+	if len(other.CondaChannels) > 0 {
+		m.CondaChannels = other.CondaChannels
+	}
+	if other.CondaChannelAlias != "" {
+		m.CondaChannelAlias = other.CondaChannelAlias
+	}
+	if other.AllowAppIndexes != nil {
+		m.AllowAppIndexes = other.AllowAppIndexes
+	}
+}
+
+// appIndexesAllowed reports whether apps may use package indexes other than
+// the operator's mirrors. Without mirrors, or when the operator explicitly
+// allows it, apps are free to choose.
+func (s *Supplier) appIndexesAllowed() bool {
+	if s.mirrors.AllowAppIndexes != nil {
+		return *s.mirrors.AllowAppIndexes
+	}
+	return !s.mirrors.configured()
+}
+
+// ApplyPackageMirrors points pip, pipenv and conda at the package mirrors
+// configured by the operator.
+func (s *Supplier) ApplyPackageMirrors() error {
+	if !s.mirrors.configured() {
+		return nil
+	}
+
+	env := map[string]string{}
+	if s.mirrors.IndexURL != "" {
+		s.Log.Info("Using package index mirror %s", stripCredentials(s.mirrors.IndexURL))
+		env["PIP_INDEX_URL"] = s.mirrors.IndexURL
+		env["PIPENV_PYPI_MIRROR"] = s.mirrors.IndexURL
+	}
+	if len(s.mirrors.ExtraIndexURLs) > 0 {
+		env["PIP_EXTRA_INDEX_URL"] = strings.Join(s.mirrors.ExtraIndexURLs, " ")
+	}
+	if len(s.mirrors.TrustedHosts) > 0 {
+		env["PIP_TRUSTED_HOST"] = strings.Join(s.mirrors.TrustedHosts, " ")
+	}
+
+	if len(s.mirrors.CondaChannels) > 0 || s.mirrors.CondaChannelAlias != "" {
+		condarc, err := s.writeCondarc()
+		if err != nil {
+			return err
+		}
+		env["CONDARC"] = condarc
+	}
+
+	for key, value := range env {
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+
+	if !s.appIndexesAllowed() {
+		s.Log.Info("The platform operator does not allow apps to use other package indexes")
+	}
+	return nil
+}
+
+func (s *Supplier) writeCondarc() (string, error) {
+	dir, err := s.stagingConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	condarc := &strings.Builder{}
+	if s.mirrors.CondaChannelAlias != "" {
+		s.Log.Info("Using conda channel alias %s", stripCredentials(s.mirrors.CondaChannelAlias))
+		fmt.Fprintf(condarc, "channel_alias: %s\n", s.mirrors.CondaChannelAlias)
+	}
+	if len(s.mirrors.CondaChannels) > 0 {
+		fmt.Fprintf(condarc, "channels:\n")
+		for _, channel := range s.mirrors.CondaChannels {
+			fmt.Fprintf(condarc, "  - %s\n", channel)
+		}
+		if !s.appIndexesAllowed() {
+			fmt.Fprintf(condarc, "allowlist_channels:\n")
+			for _, channel := range s.mirrors.CondaChannels {
+				fmt.Fprintf(condarc, "  - %s\n", channel)
+			}
+		}
+	}
+
+	path := filepath.Join(dir, ".condarc")
+	return path, os.WriteFile(path, []byte(condarc.String()), 0644)
+}
+
+// stripAppIndexes removes index options from an app's requirements file, and
+// the requirements files it includes, when the operator does not allow apps
+// to choose their own indexes.
+func (s *Supplier) stripAppIndexes(requirementsPath string) error {
+	if s.appIndexesAllowed() {
+		return nil
+	}
+	return s.stripIndexesFromFile(requirementsPath, map[string]bool{})
+}
+
+func (s *Supplier) stripIndexesFromFile(requirementsPath string, visited map[string]bool) error {
+	if visited[requirementsPath] {
+		return nil
+	}
+	visited[requirementsPath] = true
+
+	contents, err := os.ReadFile(requirementsPath)
+	if err != nil {
+		return err
+	}
+
+	if appIndexRegex.Match(contents) {
+		s.Log.Warning("Ignoring package indexes in %s, the platform operator only allows the configured mirrors", filepath.Base(requirementsPath))
+		if err := os.WriteFile(requirementsPath, appIndexRegex.ReplaceAll(contents, []byte{}), 0644); err != nil {
+			return err
+		}
+	}
+
+	for _, match := range requirementIncludeRegex.FindAllSubmatch(contents, -1) {
+		include := string(match[1])
+		if strings.Contains(include, "://") {
+			continue
+		}
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(requirementsPath), include)
+		}
+		if exists, err := libbuildpack.FileExists(include); err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+		if err := s.stripIndexesFromFile(include, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' })
+}
+
+// constraintArgs returns the pip arguments applying the operator constraints.
+// Constraint files of the app itself (-c lines in requirements.txt) are
+// combined with them by pip.
+func (s *Supplier) constraintArgs() []string {
+	var args []string
+	for _, constraintsFile := range s.constraintsFiles {
+		args = append(args, "-c", constraintsFile)
+	}
+	return args
+}
+
+// reportConstraintConflict explains a failed pip install when operator
+// constraints might be the cause.
+func (s *Supplier) reportConstraintConflict() {
+	if len(s.constraintsFiles) == 0 {
+		return
+	}
+
+	var constraints []string
+	for _, constraintsFile := range s.constraintsFiles {
+		contents, err := os.ReadFile(constraintsFile)
+		if err != nil {
+			constraints = append(constraints, constraintsFile)
+			continue
+		}
+		for _, line := range strings.Split(string(contents), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				constraints = append(constraints, line)
+			}
+		}
+	}
+
+	s.Log.Warning("pip install ran with constraints set by the platform operator:\n%s\n"+
+		"If pip reports conflicting or impossible requirements above, update the app's requirements to versions allowed by these constraints.",
+		indent(strings.Join(constraints, "\n")))
+}
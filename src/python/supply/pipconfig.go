@@ -0,0 +1,281 @@
+package supply
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"gopkg.in/ini.v1"
+)
+
+// pipConfig holds the pip options of the app, keyed by pip's option names
+// ("index-url", "extra-index-url", ...). Options of the [install] section
+// take precedence over [global].
+type pipConfig map[string][]string
+
+func (c pipConfig) first(key string) string {
+	if values := c[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// SetupPipConfig makes pip use the configuration shipped with the app. It
+// honors PIP_CONFIG_FILE (relative paths are resolved against the app),
+// pip.conf in the app root and a [tool.pip] table in pyproject.toml. When
+// both exist, pip.conf takes precedence and a merged file is generated for the
+// staging run.
+func (s *Supplier) SetupPipConfig() error {
+	configPath, err := s.appPipConfigPath()
+	if err != nil {
+		return err
+	}
+
+	pyprojectConfig, err := s.readPyprojectPipConfig()
+	if err != nil {
+		return err
+	}
+
+	if configPath == "" && len(pyprojectConfig) == 0 {
+		return nil
+	}
+
+	var file *ini.File
+	if configPath != "" {
+		if file, err = loadPipConfigFile(configPath); err != nil {
+			return fmt.Errorf("could not parse %s: %v", configPath, err)
+		}
+	} else {
+		file = ini.Empty()
+	}
+
+	generate := len(pyprojectConfig) > 0
+	if !s.appIndexesAllowed() && removeIndexOptions(file, pyprojectConfig) {
+		s.Log.Warning("Ignoring package indexes in the pip configuration of the app, the platform operator only allows the configured mirrors")
+		generate = true
+	}
+
+	if generate {
+		if len(pyprojectConfig) > 0 {
+			s.Log.Info("Using [tool.pip] from pyproject.toml")
+		}
+		global := file.Section("global")
+		for key, values := range pyprojectConfig {
+			if global.HasKey(key) || file.Section("install").HasKey(key) {
+				continue
+			}
+			if _, err := global.NewKey(key, strings.Join(values, "\n")); err != nil {
+				return err
+			}
+		}
+
+		dir, err := s.stagingConfigDir()
+		if err != nil {
+			return err
+		}
+		configPath = filepath.Join(dir, "pip.conf")
+		if err := writePipConfigFile(file, configPath); err != nil {
+			return err
+		}
+	} else {
+		s.Log.Info("Using pip configuration %s", configPath)
+	}
+
+	s.pipConfig = pipConfig{}
+	for _, section := range []string{"global", "install"} {
+		for _, key := range file.Section(section).Keys() {
+			s.pipConfig[normalizePipOption(key.Name())] = strings.Fields(key.Value())
+		}
+	}
+
+	return os.Setenv("PIP_CONFIG_FILE", configPath)
+}
+
+func (s *Supplier) appPipConfigPath() (string, error) {
+	if configPath := os.Getenv("PIP_CONFIG_FILE"); configPath != "" {
+		if !filepath.IsAbs(configPath) {
+			configPath = filepath.Join(s.Stager.BuildDir(), configPath)
+		}
+		if exists, err := libbuildpack.FileExists(configPath); err != nil {
+			return "", err
+		} else if !exists {
+			return "", fmt.Errorf("PIP_CONFIG_FILE %s does not exist", configPath)
+		}
+		return configPath, nil
+	}
+
+	configPath := filepath.Join(s.Stager.BuildDir(), "pip.conf")
+	if exists, err := libbuildpack.FileExists(configPath); err != nil {
+		return "", err
+	} else if !exists {
+		return "", nil
+	}
+	return configPath, nil
+}
+
+func (s *Supplier) readPyprojectPipConfig() (pipConfig, error) {
+	pyprojectPath := filepath.Join(s.Stager.BuildDir(), "pyproject.toml")
+	if exists, err := libbuildpack.FileExists(pyprojectPath); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, nil
+	}
+
+	contents, err := os.ReadFile(pyprojectPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseTomlTable(contents, "tool.pip"), nil
+}
+
+// mirrorPipConfig copies the index settings of the pip configuration into the
+// easy_install configuration, without overriding settings from requirements.txt.
+func (s *Supplier) mirrorPipConfig(distUtils map[string][]string) {
+	if s.pipConfig == nil {
+		return
+	}
+
+	if _, found := distUtils["index_url"]; !found && s.pipConfig.first("index-url") != "" {
+		distUtils["index_url"] = []string{s.pipConfig.first("index-url")}
+	}
+
+	distUtils["find_links"] = append(distUtils["find_links"], s.pipConfig["extra-index-url"]...)
+	distUtils["find_links"] = append(distUtils["find_links"], s.pipConfig["find-links"]...)
+	if len(distUtils["find_links"]) == 0 {
+		delete(distUtils, "find_links")
+	}
+
+	if hosts := s.pipConfig["trusted-host"]; len(hosts) > 0 {
+		if existing := distUtils["allow_hosts"]; len(existing) > 0 {
+			hosts = append([]string{existing[0]}, hosts...)
+		}
+		distUtils["allow_hosts"] = []string{strings.Join(hosts, ",")}
+	}
+}
+
+// removeIndexOptions deletes the index options from the app's pip
+// configuration and reports whether there were any.
+func removeIndexOptions(file *ini.File, pyprojectConfig pipConfig) bool {
+	removed := false
+	for _, section := range file.Sections() {
+		for _, key := range section.KeyStrings() {
+			if option := normalizePipOption(key); option == "index-url" || option == "extra-index-url" {
+				section.DeleteKey(key)
+				removed = true
+			}
+		}
+	}
+	for _, option := range []string{"index-url", "extra-index-url"} {
+		if _, found := pyprojectConfig[option]; found {
+			delete(pyprojectConfig, option)
+			removed = true
+		}
+	}
+	return removed
+}
+
+func loadPipConfigFile(path string) (*ini.File, error) {
+	return ini.LoadSources(ini.LoadOptions{
+		AllowPythonMultilineValues: true,
+		SpaceBeforeInlineComment:   true,
+	}, path)
+}
+
+// writePipConfigFile writes file in the configparser format pip reads, with
+// multiple values on indented continuation lines.
+func writePipConfigFile(file *ini.File, path string) error {
+	buf := &bytes.Buffer{}
+	for _, section := range file.Sections() {
+		if len(section.Keys()) == 0 {
+			continue
+		}
+		fmt.Fprintf(buf, "[%s]\n", section.Name())
+		for _, key := range section.Keys() {
+			fmt.Fprintf(buf, "%s = %s\n", key.Name(), strings.Join(strings.Fields(key.Value()), "\n    "))
+		}
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+func normalizePipOption(name string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), "_", "-")
+}
+
+// parseTomlTable returns the keys of the given table of a TOML document. Only
+// strings, booleans, numbers and arrays of those are supported, which covers
+// everything pip can be configured with.
+func parseTomlTable(contents []byte, table string) pipConfig {
+	config := pipConfig{}
+	inTable := false
+	var pendingKey, pendingValue string
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(stripTomlComment(scanner.Text()))
+
+		if pendingKey != "" {
+			pendingValue += " " + line
+			if strings.HasSuffix(line, "]") {
+				config[pendingKey] = parseTomlValue(pendingValue)
+				pendingKey = ""
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			inTable = strings.TrimSpace(strings.Trim(line, "[]")) == table
+			continue
+		}
+		if !inTable || line == "" {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		key = normalizePipOption(strings.Trim(strings.TrimSpace(key), `"'`))
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, "[") && !strings.HasSuffix(value, "]") {
+			pendingKey, pendingValue = key, value
+			continue
+		}
+		config[key] = parseTomlValue(value)
+	}
+
+	return config
+}
+
+func parseTomlValue(value string) []string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "[") {
+		var values []string
+		for _, item := range strings.Split(strings.Trim(value, "[]"), ",") {
+			if item = strings.Trim(strings.TrimSpace(item), `"'`); item != "" {
+				values = append(values, item)
+			}
+		}
+		return values
+	}
+	return []string{strings.Trim(value, `"'`)}
+}
+
+func stripTomlComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
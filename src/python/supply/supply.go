@@ -49,6 +49,10 @@ type Command interface {
 	RunWithOutput(cmd *exec.Cmd) ([]byte, error)
 }
 
+type AppHookRunner interface {
+	Run(scriptName string) error
+}
+
 type Reqs interface {
 	FindAnyPackage(buildDir string, searchedPackages ...string) (bool, error)
 	FindStalePackages(oldRequirementsPath, newRequirementsPath string, excludedPackages ...string) ([]string, error)
@@ -64,20 +68,61 @@ type Supplier struct {
 	Logfile                *os.File
 	HasNltkData            bool
 	removeRequirementsText bool
+	stagingDir             string
+	pipConfig              pipConfig
+	constraintsFiles       []string
+	mirrors                packageMirrors
+	installedExtraPackages []ExtraPackage
 	Requirements           Reqs
+	Environment            Environment
+	AppHooks               AppHookRunner
 }
 
 func Run(s *Supplier) error {
-	if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), "environment.yml")); err != nil {
+	defer s.RemoveStagingConfig()
+
+	if err := s.LoadOperatorConfig(); err != nil {
+		s.Log.Error("Error loading operator configuration: %v", err)
+		return err
+	}
+
+	if exists, err := conda.HasEnvironment(s.Stager.BuildDir()); err != nil {
 		s.Log.Error("Error checking existence of environment.yml: %v", err)
 		return err
 	} else if exists {
-		return conda.Run(conda.New(s.Installer, s.Stager, s.Command, s.Log))
+		return RunConda(s)
 	} else {
 		return RunPython(s)
 	}
 }
 
+func RunConda(s *Supplier) error {
+	dirSnapshot := snapshot.Dir(s.Stager.BuildDir(), s.Log)
+
+	// pip packages of environment.yml may need libffi to build
+	if err := s.HandleFfi(); err != nil {
+		s.Log.Error("Error checking ffi: %v", err)
+		return err
+	}
+
+	c := conda.New(s.Installer, s.Manifest, s.Stager, s.Command, s.Log)
+	// The hook runs with conda installed, as pip runs with Python installed
+	c.BeforeEnvironment = s.prepareDependencies
+	if err := conda.Run(c); err != nil {
+		return err
+	}
+	s.Environment = NewCondaEnvironment(c)
+
+	if isTruthy(os.Getenv(EnvCondaPipInstall)) {
+		if err := s.InstallPipRequirementsIntoConda(); err != nil {
+			s.Log.Error("Could not install pip packages into the conda environment: %v", err)
+			return err
+		}
+	}
+
+	return s.finishEnvironment(dirSnapshot)
+}
+
 func RunPython(s *Supplier) error {
 	s.Log.BeginStep("Supplying Python")
 
@@ -107,6 +152,10 @@ func RunPython(s *Supplier) error {
 		return err
 	}
 
+	if err := s.prepareDependencies(); err != nil {
+		return err
+	}
+
 	if err := s.InstallPipEnv(); err != nil {
 		s.Log.Error("Could not install pipenv: %v", err)
 		return err
@@ -149,11 +198,31 @@ func RunPython(s *Supplier) error {
 		}
 	}
 
+	return s.finishEnvironment(dirSnapshot)
+}
+
+// finishEnvironment runs the steps shared by pip and conda apps once their
+// packages are installed.
+func (s *Supplier) finishEnvironment(dirSnapshot *snapshot.DirSnapshot) error {
+	if err := s.InstallExtraPackages(); err != nil {
+		s.Log.Error("Could not install extra packages: %v", err)
+		return err
+	}
+
+	if err := s.VerifyDependencies(s.python()); err != nil {
+		return err
+	}
+
 	if err := s.DownloadNLTKCorpora(); err != nil {
 		s.Log.Error("Could not download NLTK Corpora: %v", err)
 		return err
 	}
 
+	if err := s.PrefetchArtifacts(); err != nil {
+		s.Log.Error("Could not prefetch artifacts: %v", err)
+		return err
+	}
+
 	if err := s.RewriteShebangs(); err != nil {
 		s.Log.Error("Unable to rewrite she-bangs: %s", err.Error())
 		return err
@@ -164,10 +233,19 @@ func RunPython(s *Supplier) error {
 		return err
 	}
 
-	if cacheDirSize, err := s.Command.Output(os.Getenv("XDG_CACHE_HOME"), "du", "--summarize", os.Getenv("XDG_CACHE_HOME")); err == nil {
+	if s.Environment.IsConda() {
+		condaCacheDir := filepath.Join(s.Stager.CacheDir(), "conda")
+		if cacheDirSize, err := s.Command.Output(condaCacheDir, "du", "--summarize", condaCacheDir); err == nil {
+			s.Log.Debug("Size of conda cache dir: %s", cacheDirSize)
+		}
+	} else if cacheDirSize, err := s.Command.Output(os.Getenv("XDG_CACHE_HOME"), "du", "--summarize", os.Getenv("XDG_CACHE_HOME")); err == nil {
 		s.Log.Debug("Size of pip cache dir: %s", cacheDirSize)
 	}
 
+	if err := s.runAppHook("post_supply"); err != nil {
+		return err
+	}
+
 	if s.removeRequirementsText {
 		if err := os.Remove(filepath.Join(s.Stager.BuildDir(), "requirements.txt")); err != nil {
 			s.Log.Error("Unable to clean up app directory: %s", err.Error())
@@ -180,6 +258,42 @@ func RunPython(s *Supplier) error {
 	return nil
 }
 
+// prepareDependencies runs the pre_dependencies hook of the app and then
+// configures the package sources, so that the hook can still change them.
+func (s *Supplier) prepareDependencies() error {
+	if err := s.runAppHook("pre_dependencies"); err != nil {
+		return err
+	}
+
+	if err := s.ApplyPackageMirrors(); err != nil {
+		s.Log.Error("Error applying package mirrors: %v", err)
+		return err
+	}
+
+	if err := s.SetupPipConfig(); err != nil {
+		s.Log.Error("Error setting up pip configuration: %v", err)
+		return err
+	}
+
+	if err := s.SetupPackageIndexes(); err != nil {
+		s.Log.Error("Error setting up package indexes: %v", err)
+		return err
+	}
+	return nil
+}
+
+// runAppHook runs bin/<scriptName> of the app, if the cli provided a runner.
+func (s *Supplier) runAppHook(scriptName string) error {
+	if s.AppHooks == nil {
+		return nil
+	}
+	if err := s.AppHooks.Run(scriptName); err != nil {
+		s.Log.Error("Error running %s hook: %v", scriptName, err)
+		return err
+	}
+	return nil
+}
+
 func (s *Supplier) CopyRuntimeTxt() error {
 	if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.BuildDir(), "runtime.txt")); err != nil {
 		return err
@@ -300,7 +414,7 @@ func (s *Supplier) InstallPython() error {
 }
 
 func (s *Supplier) RewriteShebangs() error {
-	files, err := filepath.Glob(filepath.Join(s.Stager.DepDir(), "bin", "*"))
+	files, err := filepath.Glob(filepath.Join(s.binDir(), "*"))
 	if err != nil {
 		return err
 	}
@@ -329,8 +443,8 @@ func (s *Supplier) InstallPip() error {
 	if pipVersion == "" {
 		s.Log.Info("Using python's pip module")
 
-		versionCmd := append(pipCommand(), "--version")
-		return s.Command.Execute(s.Stager.BuildDir(), indentWriter(os.Stdout), indentWriter(os.Stderr), versionCmd[0], versionCmd[1:]...)
+		versionCmd := append(s.pipCommand(), "--version")
+		return s.execute(s.Stager.BuildDir(), versionCmd[0], versionCmd[1:]...)
 	}
 	if pipVersion != "latest" {
 		return fmt.Errorf("invalid pip version: %s", pipVersion)
@@ -341,7 +455,7 @@ func (s *Supplier) InstallPip() error {
 		return err
 	}
 
-	if err := s.Command.Execute(s.Stager.BuildDir(), indentWriter(os.Stdout), indentWriter(os.Stderr),
+	if err := s.execute(s.Stager.BuildDir(),
 		"python",
 		"-m", "pip",
 		"install", "pip",
@@ -559,7 +673,7 @@ func (s *Supplier) UninstallUnusedDependencies() error {
 
 	if requirementsDeclaredExists {
 		fileContents, _ := os.ReadFile(filepath.Join(s.Stager.DepDir(), "python", "requirements-declared.txt"))
-		s.Log.Info("requirements-declared: %s", string(fileContents))
+		s.Log.Info("requirements-declared: %s", redact(string(fileContents)))
 
 		staleContents, err := s.Requirements.FindStalePackages(
 			filepath.Join(s.Stager.DepDir(), "python", "requirements-declared.txt"),
@@ -581,10 +695,8 @@ func (s *Supplier) UninstallUnusedDependencies() error {
 		}
 
 		s.Log.BeginStep("Uninstalling stale dependencies")
-		if err := s.Command.Execute(
+		if err := s.execute(
 			s.Stager.BuildDir(),
-			indentWriter(os.Stdout),
-			indentWriter(os.Stderr),
 			"python",
 			"-m",
 			"pip",
@@ -610,6 +722,10 @@ func (s *Supplier) RunPipUnvendored() error {
 		return nil
 	}
 
+	if err := s.stripAppIndexes(requirementsPath); err != nil {
+		return fmt.Errorf("could not remove package indexes from requirements.txt: %v", err)
+	}
+
 	// Search lines from requirements.txt that begin with -i, --index-url, --extra-index-url or --trusted-host
 	// and add them to the pydistutils file. We do this so that easy_install will use
 	// the same indexes as pip. This may not actually be necessary because it's possible that
@@ -643,22 +759,32 @@ func (s *Supplier) RunPipUnvendored() error {
 		distUtils["allow_hosts"] = []string{strings.Join(allowHosts, ",")}
 	}
 
+	s.mirrorPipConfig(distUtils)
+
+	// Indexes from bound services are passed to pip through the environment
+	if _, found := distUtils["index_url"]; !found && os.Getenv("PIP_INDEX_URL") != "" {
+		distUtils["index_url"] = []string{os.Getenv("PIP_INDEX_URL")}
+	}
+
 	if err := writePyDistUtils(distUtils); err != nil {
 		return err
 	}
 
-	if err := s.runPipInstall(
+	installArgs := append([]string{
 		"-r", requirementsPath,
 		"--ignore-installed",
 		"--exists-action=w",
-		"--src="+filepath.Join(s.Stager.DepDir(), "src"),
+		"--src=" + filepath.Join(s.Stager.DepDir(), "src"),
 		"--disable-pip-version-check",
 		"--no-warn-script-location",
-	); err != nil {
+	}, s.constraintArgs()...)
+
+	if err := s.runPipInstall(installArgs...); err != nil {
+		s.reportConstraintConflict()
 		return fmt.Errorf("could not run pip: %v", err)
 	}
 
-	return s.Stager.LinkDirectoryInDepDir(filepath.Join(s.Stager.DepDir(), "python", "bin"), "bin")
+	return s.linkScripts()
 }
 
 func (s *Supplier) RunPipVendored() error {
@@ -694,6 +820,7 @@ func (s *Supplier) RunPipVendored() error {
 		s.Log.Info("Using the pip --no-build-isolation flag since it is available")
 		installArgs = append(installArgs, "--no-build-isolation")
 	}
+	installArgs = append(installArgs, s.constraintArgs()...)
 
 	// Remove lines from requirements.txt that begin with -i, --index-url and --extra-index-url
 	// because specifying index links here makes pip always want internet access,
@@ -723,11 +850,12 @@ func (s *Supplier) RunPipVendored() error {
 	}
 
 	if err := s.runPipInstall(installArgs...); err != nil {
+		s.reportConstraintConflict()
 		s.Log.Info("Running pip install failed. You need to include all dependencies in the vendor directory.")
 		return fmt.Errorf("could not run pip: %v", err)
 	}
 
-	return s.Stager.LinkDirectoryInDepDir(filepath.Join(s.Stager.DepDir(), "python", "bin"), "bin")
+	return s.linkScripts()
 }
 
 // sdist packages have 2 kinds of dependencies: build-time deps and
@@ -752,7 +880,7 @@ func (s *Supplier) InstallCommonBuildDependencies() error {
 			return fmt.Errorf("could not prepare build-time dependency %s: %v", dep, err)
 		}
 		s.Log.Info("Installing build-time dependency %s (bootstrap)", dep)
-		if err := s.runPipInstall(tempPath, "--no-build-isolation"); err != nil {
+		if err := s.runPipInstall(append([]string{tempPath, "--no-build-isolation"}, s.constraintArgs()...)...); err != nil {
 			return fmt.Errorf("could not bootstrap-install %s: %v", dep, err)
 		}
 	}
@@ -760,12 +888,12 @@ func (s *Supplier) InstallCommonBuildDependencies() error {
 	for _, dep := range []string{"wheel", "setuptools"} {
 		s.Log.Info("Installing build-time dependency %s", dep)
 		args := []string{dep, "--no-index", "--no-build-isolation", "--upgrade-strategy=only-if-needed", fmt.Sprintf("--find-links=%s", tempPath)}
-		if err := s.runPipInstall(args...); err != nil {
+		if err := s.runPipInstall(append(args, s.constraintArgs()...)...); err != nil {
+			s.reportConstraintConflict()
 			return fmt.Errorf("could not install build-time dependency %s: %v", dep, err)
 		}
 	}
 
-
 	return nil
 }
 
@@ -788,9 +916,22 @@ export FORWARDED_ALLOW_IPS='*'
 export GUNICORN_CMD_ARGS=${GUNICORN_CMD_ARGS:-'--access-logfile -'}
 `, s.Stager.DepsIdx(), s.Stager.DepsIdx())
 
+	// A conda environment finds its own standard library and site-packages,
+	// pointing it at the buildpack's Python would break it
+	if s.Environment.IsConda() {
+		delete(environmentVars, "PYTHONPATH")
+		delete(environmentVars, "PYTHONHOME")
+		scriptContents = `export LANG=${LANG:-en_US.UTF-8}
+export PYTHONHASHSEED=${PYTHONHASHSEED:-random}
+export PYTHONUNBUFFERED=1
+export FORWARDED_ALLOW_IPS='*'
+export GUNICORN_CMD_ARGS=${GUNICORN_CMD_ARGS:-'--access-logfile -'}
+`
+	}
+
 	if s.HasNltkData {
 		scriptContents += fmt.Sprintf(`export NLTK_DATA=$DEPS_DIR/%s/python/nltk_data`, s.Stager.DepsIdx())
-		environmentVars["NLTK_DATA"] = filepath.Join(s.Stager.DepDir(), "python", "nltk_data")
+		environmentVars["NLTK_DATA"] = s.nltkDataDir()
 	}
 
 	for envVar, envValue := range environmentVars {
@@ -803,7 +944,7 @@ export GUNICORN_CMD_ARGS=${GUNICORN_CMD_ARGS:-'--access-logfile -'}
 }
 
 func (s *Supplier) DownloadNLTKCorpora() error {
-	if err := s.Command.Execute("/", io.Discard, io.Discard, "python", "-m", "nltk.downloader", "-h"); err != nil {
+	if err := s.Command.Execute("/", io.Discard, io.Discard, s.python(), "-m", "nltk.downloader", "-h"); err != nil {
 		return nil
 	}
 
@@ -820,16 +961,52 @@ func (s *Supplier) DownloadNLTKCorpora() error {
 	if err != nil {
 		return err
 	}
-	sPackages := strings.TrimSpace(strings.NewReplacer("\r", " ", "\n", " ").Replace(string(bPackages)))
-	args := []string{"-m", "nltk.downloader", "-d", filepath.Join(s.Stager.DepDir(), "python", "nltk_data")}
-	args = append(args, strings.Split(sPackages, " ")...)
+	corpora := strings.Fields(string(bPackages))
+	if len(corpora) == 0 {
+		s.Log.Info("nltk.txt is empty, not downloading any corpora")
+		return nil
+	}
+
+	key := nltkCacheKey(corpora)
+	if restored, err := s.restoreNltkCache(key); err != nil {
+		s.Log.Warning("Could not restore cached NLTK corpora: %v", err)
+	} else if restored {
+		s.Log.Info("Using cached NLTK packages: %s", strings.Join(corpora, " "))
+		// The vendored corpora may have changed since they were cached
+		if _, err := s.copyVendoredNltkData(corpora); err != nil {
+			return fmt.Errorf("could not copy vendored NLTK data: %v", err)
+		}
+		if err := s.verifyNltkData(corpora); err != nil {
+			return err
+		}
+		s.HasNltkData = true
+		return nil
+	}
+
+	missing, err := s.copyVendoredNltkData(corpora)
+	if err != nil {
+		return fmt.Errorf("could not copy vendored NLTK data: %v", err)
+	}
+
+	if len(missing) > 0 {
+		args := []string{"-m", "nltk.downloader", "-d", s.nltkDataDir()}
+		args = append(args, missing...)
+
+		s.Log.BeginStep("Downloading NLTK packages: %s", strings.Join(missing, " "))
 
-	s.Log.BeginStep("Downloading NLTK packages: %s", sPackages)
+		if err := s.execute("/", s.python(), args...); err != nil {
+			return err
+		}
+	}
 
-	if err := s.Command.Execute("/", indentWriter(os.Stdout), indentWriter(os.Stderr), "python", args...); err != nil {
+	if err := s.verifyNltkData(corpora); err != nil {
 		return err
 	}
 
+	if err := s.saveNltkCache(key); err != nil {
+		s.Log.Warning("Could not cache NLTK corpora: %v", err)
+	}
+
 	s.HasNltkData = true
 
 	return nil
@@ -851,7 +1028,11 @@ func writePyDistUtils(distUtils map[string][]string) error {
 	b := strings.Builder{}
 	b.WriteString("[easy_install]\n")
 	for k, v := range distUtils {
-		b.WriteString(fmt.Sprintf("%s = %s\n", k, strings.Join(v, "\n\t")))
+		values := make([]string, len(v))
+		for i, value := range v {
+			values[i] = stripCredentials(value)
+		}
+		b.WriteString(fmt.Sprintf("%s = %s\n", k, strings.Join(values, "\n\t")))
 	}
 
 	if err := os.WriteFile(pyDistUtilsPath, []byte(b.String()), os.ModePerm); err != nil {
@@ -877,17 +1058,17 @@ func (s *Supplier) shouldRunPip() (bool, string, error) {
 	return true, requirementsPath, nil
 }
 
-func pipCommand() []string {
-	if os.Getenv(EnvPipVersion) != "" {
+func (s *Supplier) pipCommand() []string {
+	if os.Getenv(EnvPipVersion) != "" && !s.Environment.IsConda() {
 		return []string{"pip"}
 	}
-	return []string{"python", "-m", "pip"}
+	return []string{s.python(), "-m", "pip"}
 }
 
 func (s *Supplier) runPipInstall(args ...string) error {
-	installCmd := append(append(pipCommand(), "install"), args...)
-	s.Log.Info("%s", strings.Join(installCmd, " "))
-	return s.Command.Execute(s.Stager.BuildDir(), indentWriter(os.Stdout), indentWriter(os.Stderr), installCmd[0], installCmd[1:]...)
+	installCmd := append(append(s.pipCommand(), "install"), args...)
+	s.Log.Info("%s", redact(strings.Join(installCmd, " ")))
+	return s.execute(s.Stager.BuildDir(), installCmd[0], installCmd[1:]...)
 }
 
 func (s *Supplier) formatVersion(version string) string {
@@ -906,14 +1087,55 @@ func (s *Supplier) writeTempRequirementsTxt(content string) error {
 	return os.WriteFile(filepath.Join(s.Stager.BuildDir(), "requirements.txt"), []byte(content), 0644)
 }
 
+// stagingConfigDir returns a directory for configuration that is only needed
+// while staging, such as credentials. It is outside of the build and deps
+// dirs so that nothing in it ends up in the droplet.
+func (s *Supplier) stagingConfigDir() (string, error) {
+	if s.stagingDir == "" {
+		dir, err := os.MkdirTemp("", "python-buildpack.staging.")
+		if err != nil {
+			return "", err
+		}
+		s.stagingDir = dir
+	}
+	return s.stagingDir, nil
+}
+
+// RemoveStagingConfig deletes the staging-only configuration and the
+// environment variables pointing to it.
+func (s *Supplier) RemoveStagingConfig() error {
+	if s.stagingDir == "" {
+		return nil
+	}
+	for _, env := range []string{"NETRC", "PIP_CONFIG_FILE"} {
+		if strings.HasPrefix(os.Getenv(env), s.stagingDir) {
+			if err := os.Unsetenv(env); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.RemoveAll(s.stagingDir); err != nil {
+		return err
+	}
+	s.stagingDir = ""
+	return nil
+}
+
 func (s *Supplier) hasBuildOptions() bool {
-	helpCommand := append(pipCommand(), "install", "--no-build-isolation", "-h")
+	helpCommand := append(s.pipCommand(), "install", "--no-build-isolation", "-h")
 	err := s.Command.Execute(s.Stager.BuildDir(), nil, nil, helpCommand[0], helpCommand[1:]...)
 	return nil == err
 }
 
-func indentWriter(writer io.Writer) io.Writer {
-	return text.NewIndentWriter(writer, []byte("       "))
+// execute runs program with its output indented into the staging log and
+// credentials redacted from it.
+func (s *Supplier) execute(dir string, program string, args ...string) error {
+	stdout := &redactingWriter{writer: text.NewIndentWriter(os.Stdout, []byte("       "))}
+	stderr := &redactingWriter{writer: text.NewIndentWriter(os.Stderr, []byte("       "))}
+	err := s.Command.Execute(dir, stdout, stderr, program, args...)
+	stdout.Flush()
+	stderr.Flush()
+	return err
 }
 
 // sdists are identified by .tar.gz, .tgz, or .zip extensions
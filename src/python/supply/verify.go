@@ -0,0 +1,122 @@
+package supply
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/python-buildpack/src/python/procfile"
+)
+
+const (
+	EnvVerifyDependencies = "BP_VERIFY_DEPENDENCIES"
+	EnvVerifyImports      = "BP_VERIFY_IMPORTS"
+)
+
+// importCheckScript imports every module given on the command line and
+// prints the last line of the traceback for each one that fails.
+const importCheckScript = `import importlib, sys, traceback
+failed = False
+for name in sys.argv[1:]:
+    try:
+        importlib.import_module(name)
+    except BaseException:
+        failed = True
+        print("%s: %s" % (name, traceback.format_exc().strip().splitlines()[-1]))
+sys.exit(1 if failed else 0)
+`
+
+var entrypointModuleRegex = regexp.MustCompile(`^([A-Za-z_][\w.]*):[A-Za-z_][\w.]*(\(.*\))?$`)
+
+// VerifyDependencies runs the staged interpreter's dependency consistency
+// check and imports the modules the app needs to start. It is only enabled
+// when BP_VERIFY_DEPENDENCIES or BP_VERIFY_IMPORTS is set.
+func (s *Supplier) VerifyDependencies(python string) error {
+	checkDependencies := isTruthy(os.Getenv(EnvVerifyDependencies))
+	modules := strings.Fields(strings.ReplaceAll(os.Getenv(EnvVerifyImports), ",", " "))
+	if !checkDependencies && len(modules) == 0 {
+		return nil
+	}
+
+	s.Log.BeginStep("Verifying installed dependencies")
+
+	var failures []string
+
+	if checkDependencies {
+		output := new(bytes.Buffer)
+		if err := s.Command.Execute(s.Stager.BuildDir(), output, output, python, "-m", "pip", "check"); err != nil {
+			failures = append(failures, fmt.Sprintf("pip check reported broken requirements:\n%s", strings.TrimSpace(output.String())))
+		}
+
+		if len(modules) == 0 {
+			var err error
+			if modules, err = s.entrypointModules(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(modules) > 0 {
+		s.Log.Info("Importing %s", strings.Join(modules, ", "))
+		output := new(bytes.Buffer)
+		args := append([]string{"-c", importCheckScript}, modules...)
+		if err := s.Command.Execute(s.Stager.BuildDir(), output, output, python, args...); err != nil {
+			failures = append(failures, fmt.Sprintf("could not import all modules:\n%s", strings.TrimSpace(output.String())))
+		}
+	}
+
+	if len(failures) > 0 {
+		s.Log.Error("Dependency verification failed:\n\n%s\n\nFix the dependency set of the app or unset %s and %s to skip verification.",
+			indent(strings.Join(failures, "\n\n")), EnvVerifyDependencies, EnvVerifyImports)
+		return fmt.Errorf("dependency verification failed")
+	}
+
+	s.Log.Info("Dependencies verified")
+	return nil
+}
+
+// entrypointModules returns the module of the WSGI/ASGI application that the
+// web process in the Procfile serves, e.g. "myapp.wsgi" for
+// "gunicorn myapp.wsgi:application".
+func (s *Supplier) entrypointModules() ([]string, error) {
+	procfilePath := filepath.Join(s.Stager.BuildDir(), "Procfile")
+	if exists, err := libbuildpack.FileExists(procfilePath); err != nil {
+		return nil, err
+	} else if !exists {
+		s.Log.Debug("No Procfile found, not inferring modules to import")
+		return nil, nil
+	}
+
+	p, err := procfile.Load(procfilePath)
+	if err != nil {
+		s.Log.Debug("Could not parse the Procfile: %v", err)
+		return nil, nil
+	}
+
+	if command, found := p.Command("web"); found {
+		for _, arg := range strings.Fields(command) {
+			if match := entrypointModuleRegex.FindStringSubmatch(strings.Trim(arg, `'"`)); match != nil {
+				return []string{match[1]}, nil
+			}
+		}
+	}
+
+	s.Log.Debug("Could not infer the entrypoint module from the Procfile")
+	return nil, nil
+}
+
+func isTruthy(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
+
+func indent(s string) string {
+	return "       " + strings.ReplaceAll(s, "\n", "\n       ")
+}